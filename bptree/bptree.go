@@ -0,0 +1,691 @@
+// 通用的并发安全B+树，key可以是任意可比较大小的类型，value可以是任意类型
+// 内部节点的每个key是对应子节点的最大值，叶子节点通过next和prev指针串成双向链表
+// 并发控制使用锁耦合(latch crabbing)，不需要调用方额外加锁：
+// 读操作从根节点往下，拿到子节点的读锁之后释放父节点的读锁
+// 写操作从根节点往下加写锁，如果子节点是安全的(这次操作不会导致它分裂、合并或者最大值变化)，就释放所有祖先节点的锁
+// 所以写操作修改父节点时一定持有父节点的锁，兄弟节点只在持有共同父节点的写锁时才加锁，不会死锁
+
+package bptree
+
+import (
+	"cmp"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// 阶数的最小值，保证非根节点至少有两个key
+const MinOrder = 4
+
+type node[K cmp.Ordered, V any] struct {
+	keys     []K
+	values   []V // 只有叶子节点有，和keys一一对应
+	children []*node[K, V]
+	parent   *node[K, V]
+	leaf     bool
+	next     *node[K, V]
+	// prev由修改相邻节点的写操作更新，不持有本节点的锁，所以是原子指针，
+	// 读的时候只是一个提示，需要在持有prev节点的锁时确认它的next还指向本节点
+	prev    atomic.Pointer[node[K, V]]
+	version uint64 // 叶子节点的key或者next每次变化都加一，迭代器用来判断复制的数据是否过时
+	mu      sync.RWMutex
+}
+
+// 树的结构，rootMu保护root指针，相当于根节点之上的一把锁
+type Tree[K cmp.Ordered, V any] struct {
+	root     *node[K, V]
+	rootMu   sync.RWMutex
+	maxLen   int // 每个节点最多的key数量，也就是阶数
+	leastLen int // 非根节点最少的key数量
+	size     atomic.Int64
+}
+
+// 创建一棵阶数为order的树，order是每个节点最多的key数量，不能小于MinOrder
+func New[K cmp.Ordered, V any](order int) *Tree[K, V] {
+	if order < MinOrder {
+		panic(fmt.Sprintf("bptree: order must be at least %d, got %d", MinOrder, order))
+	}
+	return &Tree[K, V]{
+		maxLen:   order,
+		leastLen: order / 2,
+	}
+}
+
+// 树的阶数
+func (t *Tree[K, V]) Order() int {
+	return t.maxLen
+}
+
+// 数据数量，O(1)
+func (t *Tree[K, V]) Len() int {
+	return int(t.size.Load())
+}
+
+// 一次写操作持有的锁，按从上到下的顺序记录
+type latchPath[K cmp.Ordered, V any] struct {
+	t        *Tree[K, V]
+	rootHeld bool
+	nodes    []*node[K, V]
+}
+
+// 释放目前持有的所有锁
+func (p *latchPath[K, V]) release() {
+	if p.rootHeld {
+		p.t.rootMu.Unlock()
+		p.rootHeld = false
+	}
+	for _, n := range p.nodes {
+		n.mu.Unlock()
+	}
+	p.nodes = p.nodes[:0]
+}
+
+// 写操作从根节点往下加写锁，safe判断节点是否安全，安全时释放祖先节点的锁
+// 返回时叶子节点一定持有写锁，树为空时返回nil并持有rootMu
+func (t *Tree[K, V]) lockPath(key K, safe func(n *node[K, V], isRoot bool) bool) (*latchPath[K, V], *node[K, V]) {
+	p := &latchPath[K, V]{t: t}
+	t.rootMu.Lock()
+	p.rootHeld = true
+	current := t.root
+	if current == nil {
+		return p, nil
+	}
+	current.mu.Lock()
+	if safe(current, true) {
+		p.release()
+	}
+	p.nodes = append(p.nodes, current)
+	for !current.leaf {
+		child := current.children[childIndex(current, key)]
+		child.mu.Lock()
+		if safe(child, false) {
+			p.release()
+		}
+		p.nodes = append(p.nodes, child)
+		current = child
+	}
+	return p, current
+}
+
+// 插入时节点安全的条件：不会分裂，并且key不大于节点的最大值，不需要修改上层的key
+func (t *Tree[K, V]) insertSafe(key K) func(n *node[K, V], isRoot bool) bool {
+	return func(n *node[K, V], isRoot bool) bool {
+		if len(n.keys) >= t.maxLen {
+			return false
+		}
+		return isRoot || key <= n.keys[len(n.keys)-1]
+	}
+}
+
+// 删除时节点安全的条件：删除之后不会低于最小长度，并且删除的不是节点的最大值
+// 根节点没有最小长度限制，只要删除后不会变空或者只剩一个子节点就是安全的
+func (t *Tree[K, V]) deleteSafe(key K) func(n *node[K, V], isRoot bool) bool {
+	return func(n *node[K, V], isRoot bool) bool {
+		if isRoot {
+			if n.leaf {
+				return len(n.keys) > 1
+			}
+			return len(n.keys) > 2
+		}
+		return len(n.keys) > t.leastLen && key != n.keys[len(n.keys)-1]
+	}
+}
+
+// 读操作从根节点往下加读锁，找到第一个大于key(strict为true)或者不小于key的数据所在的叶子节点
+// first为true时忽略key，找最左边的叶子节点
+// 返回时叶子节点持有读锁，同时返回数据在叶子节点中的位置，没有满足条件的数据时返回nil
+func (t *Tree[K, V]) seekLeaf(key K, strict bool, first bool) (*node[K, V], int) {
+	t.rootMu.RLock()
+	current := t.root
+	if current == nil {
+		t.rootMu.RUnlock()
+		return nil, 0
+	}
+	current.mu.RLock()
+	t.rootMu.RUnlock()
+	for {
+		index := 0
+		if !first {
+			index = seekIndex(current.keys, key, strict)
+		}
+		if index >= len(current.keys) {
+			current.mu.RUnlock()
+			return nil, 0
+		}
+		if current.leaf {
+			return current, index
+		}
+		child := current.children[index]
+		child.mu.RLock()
+		current.mu.RUnlock()
+		current = child
+	}
+}
+
+// 和seekLeaf相反，找到最后一个小于key(strict为true)或者不大于key的数据所在的叶子节点，last为true时找最右边的叶子节点
+// 向下查找时记录左边相邻子树的最大值，如果到了叶子节点发现没有满足条件的数据，要找的就是这个最大值，重新查找一次
+func (t *Tree[K, V]) seekLeafReverse(key K, strict bool, last bool) (*node[K, V], int) {
+	for {
+		t.rootMu.RLock()
+		current := t.root
+		if current == nil {
+			t.rootMu.RUnlock()
+			return nil, 0
+		}
+		current.mu.RLock()
+		t.rootMu.RUnlock()
+		var pred K
+		hasPred := false
+		for !current.leaf {
+			index := len(current.children) - 1
+			if !last {
+				index = childIndex(current, key)
+			}
+			if index > 0 {
+				pred = current.keys[index-1]
+				hasPred = true
+			}
+			child := current.children[index]
+			child.mu.RLock()
+			current.mu.RUnlock()
+			current = child
+		}
+		index := len(current.keys) - 1
+		if !last {
+			index = seekIndex(current.keys, key, !strict) - 1
+		}
+		if index >= 0 {
+			return current, index
+		}
+		current.mu.RUnlock()
+		if !hasPred {
+			return nil, 0
+		}
+		key, strict = pred, false
+	}
+}
+
+// 查找操作
+func (t *Tree[K, V]) Get(key K) (V, bool) {
+	var zero V
+	leaf, index := t.seekLeaf(key, false, false)
+	if leaf == nil {
+		return zero, false
+	}
+	defer leaf.mu.RUnlock()
+	if leaf.keys[index] != key {
+		return zero, false
+	}
+	return leaf.values[index], true
+}
+
+// 最小的key和对应的value
+func (t *Tree[K, V]) Min() (K, V, bool) {
+	var k K
+	var v V
+	leaf, index := t.seekLeaf(k, false, true)
+	if leaf == nil {
+		return k, v, false
+	}
+	defer leaf.mu.RUnlock()
+	return leaf.keys[index], leaf.values[index], true
+}
+
+// 最大的key和对应的value
+func (t *Tree[K, V]) Max() (K, V, bool) {
+	var k K
+	var v V
+	leaf, index := t.seekLeafReverse(k, false, true)
+	if leaf == nil {
+		return k, v, false
+	}
+	defer leaf.mu.RUnlock()
+	return leaf.keys[index], leaf.values[index], true
+}
+
+// 插入或替换，返回被替换的旧值
+func (t *Tree[K, V]) Put(key K, value V) (V, bool) {
+	var old V
+	var replaced bool
+	t.Upsert(key, func(o V, exists bool) V {
+		old, replaced = o, exists
+		return value
+	})
+	return old, replaced
+}
+
+// 插入或更新，fn根据旧值(不存在时exists为false)计算新值，整个过程持有叶子节点的写锁，返回写入的新值
+func (t *Tree[K, V]) Upsert(key K, fn func(old V, exists bool) V) V { //需要把最大值的key修改
+	p, leaf := t.lockPath(key, t.insertSafe(key))
+	defer p.release()
+	var zero V
+	if leaf == nil {
+		value := fn(zero, false)
+		t.root = &node[K, V]{
+			keys:   []K{key},
+			values: []V{value},
+			leaf:   true,
+		}
+		t.size.Add(1)
+		return value
+	}
+	index := findIndex(leaf.keys, key)
+
+	if index < len(leaf.keys) && leaf.keys[index] == key {
+		// 更新
+		leaf.values[index] = fn(leaf.values[index], true)
+		return leaf.values[index]
+	}
+	value := fn(zero, false)
+	// 修改插入某个节点的key最大值的情况
+	if key > leaf.keys[len(leaf.keys)-1] {
+		current := leaf
+		for current.parent != nil {
+			currentIndex := getNodeIndex(current.parent, current)
+			current = current.parent
+			current.keys[currentIndex] = key
+		}
+	}
+	//普通插入操作
+	leaf.keys = insertAt(leaf.keys, index, key)
+	leaf.values = insertAt(leaf.values, index, value)
+	leaf.version++
+	t.size.Add(1)
+
+	if len(leaf.keys) > t.maxLen {
+		//超过最大长度，需要分裂节点
+		t.splitLeafNode(leaf)
+	}
+	return value
+}
+
+// 分裂出来的新节点在插入父节点之前其他操作访问不到，不需要加锁
+func (t *Tree[K, V]) splitLeafNode(n *node[K, V]) {
+	rangeIndex := (len(n.keys) + 1) / 2
+	newNode := &node[K, V]{
+		keys:   make([]K, len(n.keys[rangeIndex:])),
+		values: make([]V, len(n.keys[rangeIndex:])),
+		leaf:   true,
+		next:   n.next,
+		parent: n.parent,
+	}
+	copy(newNode.keys, n.keys[rangeIndex:])
+	copy(newNode.values, n.values[rangeIndex:])
+	newNode.prev.Store(n)
+	if n.next != nil {
+		n.next.prev.Store(newNode)
+	}
+	n.next = newNode
+	n.keys = n.keys[:rangeIndex]
+	n.values = n.values[:rangeIndex]
+	t.insertToParent(n, newNode)
+}
+
+// 分裂的节点插入父节点
+func (t *Tree[K, V]) insertToParent(left *node[K, V], right *node[K, V]) {
+	parent := left.parent
+	if parent == nil {
+		newRoot := &node[K, V]{
+			keys:     []K{left.keys[len(left.keys)-1], right.keys[len(right.keys)-1]},
+			children: []*node[K, V]{left, right},
+		}
+		left.parent = newRoot
+		right.parent = newRoot
+		t.root = newRoot
+		return
+	}
+	insertIndex := findIndex(parent.keys, left.keys[len(left.keys)-1])
+	parent.keys = insertAt(parent.keys, insertIndex, left.keys[len(left.keys)-1])
+	parent.children = insertAt(parent.children, insertIndex+1, right)
+	//父节点超过最大长度，分裂内部节点
+	if len(parent.keys) > t.maxLen {
+		t.splitNonLeafNode(parent)
+	}
+}
+
+func (t *Tree[K, V]) splitNonLeafNode(n *node[K, V]) {
+	rangeIndex := (len(n.keys) + 1) / 2
+	newNode := &node[K, V]{
+		keys:     make([]K, len(n.keys[rangeIndex:])),
+		children: make([]*node[K, V], len(n.children[rangeIndex:])),
+		parent:   n.parent,
+	}
+	copy(newNode.keys, n.keys[rangeIndex:])
+	copy(newNode.children, n.children[rangeIndex:])
+	for _, child := range newNode.children {
+		child.parent = newNode
+	}
+	n.keys = n.keys[:rangeIndex]
+	n.children = n.children[:rangeIndex]
+	t.insertToParent(n, newNode)
+}
+
+// 删除操作，返回被删除的值
+func (t *Tree[K, V]) Delete(key K) (V, bool) {
+	var zero V
+	p, leaf := t.lockPath(key, t.deleteSafe(key))
+	defer p.release()
+	if leaf == nil {
+		return zero, false
+	}
+	leafIndex := findIndex(leaf.keys, key)
+
+	//找不到
+	if leafIndex >= len(leaf.keys) || leaf.keys[leafIndex] != key {
+		return zero, false
+	}
+	old := leaf.values[leafIndex]
+	if leaf == t.root && len(leaf.keys) == 1 {
+		t.root = nil
+		t.size.Add(-1)
+		return old, true
+	}
+
+	// 如果删除叶子结点里面的最大值，需要更新父节点的key，直到某一层的最大值不变为止
+	if key == leaf.keys[len(leaf.keys)-1] && len(leaf.keys) > 1 {
+		changeKey := leaf.keys[len(leaf.keys)-2]
+		current := leaf.parent
+		for current != nil {
+			i := findIndex(current.keys, key)
+			if i >= len(current.keys) || current.keys[i] != key {
+				break
+			}
+			current.keys[i] = changeKey
+			if i != len(current.keys)-1 {
+				break
+			}
+			current = current.parent
+		}
+	}
+	//正常删除操作
+	leaf.keys = removeAt(leaf.keys, leafIndex)
+	leaf.values = removeAt(leaf.values, leafIndex)
+	leaf.version++
+	t.size.Add(-1)
+
+	//如果小于最小长度，需要平衡叶子节点
+	if len(leaf.keys) < t.leastLen {
+		t.balanceLeafNode(leaf)
+	}
+	return old, true
+}
+
+// 平衡叶子节点，此时父节点一定持有写锁，兄弟节点在修改前加锁
+func (t *Tree[K, V]) balanceLeafNode(leaf *node[K, V]) {
+	if leaf.parent == nil {
+		return
+	}
+	parent := leaf.parent
+	index := getNodeIndex(parent, leaf)
+	// 向左兄弟借
+	if index > 0 {
+		leftSibling := parent.children[index-1]
+		leftSibling.mu.Lock()
+		if len(leftSibling.keys) > t.leastLen {
+			last := len(leftSibling.keys) - 1
+			leaf.keys = insertAt(leaf.keys, 0, leftSibling.keys[last])
+			leaf.values = insertAt(leaf.values, 0, leftSibling.values[last])
+			leftSibling.keys = leftSibling.keys[:last]
+			leftSibling.values = leftSibling.values[:last]
+			leftSibling.version++
+			parent.keys[index-1] = leftSibling.keys[last-1]
+			leftSibling.mu.Unlock()
+			return
+		}
+		leftSibling.mu.Unlock()
+	}
+	//向右兄弟借
+	if index < len(parent.keys)-1 {
+		rightSibling := parent.children[index+1]
+		rightSibling.mu.Lock()
+		if len(rightSibling.keys) > t.leastLen {
+			leaf.keys = append(leaf.keys, rightSibling.keys[0])
+			leaf.values = append(leaf.values, rightSibling.values[0])
+			rightSibling.keys = rightSibling.keys[1:]
+			rightSibling.values = rightSibling.values[1:]
+			rightSibling.version++
+			parent.keys[index] = leaf.keys[len(leaf.keys)-1]
+			rightSibling.mu.Unlock()
+			return
+		}
+		rightSibling.mu.Unlock()
+	}
+	// 合并节点 将本节点并入左兄弟
+	if index > 0 {
+		leftSibling := parent.children[index-1]
+		leftSibling.mu.Lock()
+		leftSibling.keys = append(leftSibling.keys, leaf.keys...)
+		leftSibling.values = append(leftSibling.values, leaf.values...)
+		leftSibling.next = leaf.next
+		if leaf.next != nil {
+			leaf.next.prev.Store(leftSibling)
+		}
+		leftSibling.version++
+		leftSibling.mu.Unlock()
+		//删除本节点
+		t.deleteFromParent(parent, index-1, index)
+	} else {
+		//将右兄弟并入本节点
+		rightSibling := parent.children[index+1]
+		rightSibling.mu.Lock()
+		leaf.keys = append(leaf.keys, rightSibling.keys...)
+		leaf.values = append(leaf.values, rightSibling.values...)
+		leaf.next = rightSibling.next
+		if rightSibling.next != nil {
+			rightSibling.next.prev.Store(leaf)
+		}
+		// 被合并的节点已经不在树里了，正在读它的迭代器要重新查找
+		rightSibling.version++
+		rightSibling.mu.Unlock()
+		t.deleteFromParent(parent, index, index+1)
+	}
+	t.collapseRoot(parent)
+}
+
+func (t *Tree[K, V]) deleteFromParent(parent *node[K, V], indexLeft int, indexRight int) {
+	parent.keys = removeAt(parent.keys, indexLeft)
+	parent.children = removeAt(parent.children, indexRight)
+
+	if len(parent.keys) < t.leastLen {
+		//如果父节点的key小于最小长度，需要平衡父节点，也就是非叶结点
+		t.balanceNonLeafNode(parent)
+	}
+}
+
+func (t *Tree[K, V]) balanceNonLeafNode(n *node[K, V]) {
+	if n.parent == nil {
+		return
+	}
+	parent := n.parent
+	index := getNodeIndex(parent, n)
+	// 借左右子节点
+	if index > 0 {
+		leftSibling := parent.children[index-1]
+		leftSibling.mu.Lock()
+		if len(leftSibling.keys) > t.leastLen {
+			last := len(leftSibling.keys) - 1
+			borrowChild := leftSibling.children[last]
+			n.keys = insertAt(n.keys, 0, leftSibling.keys[last])
+			n.children = insertAt(n.children, 0, borrowChild)
+			borrowChild.parent = n
+			parent.keys[index-1] = leftSibling.keys[last-1]
+			leftSibling.keys = leftSibling.keys[:last]
+			leftSibling.children = leftSibling.children[:last]
+			leftSibling.mu.Unlock()
+			return
+		}
+		leftSibling.mu.Unlock()
+	}
+	if index < len(parent.keys)-1 {
+		rightSibling := parent.children[index+1]
+		rightSibling.mu.Lock()
+		if len(rightSibling.keys) > t.leastLen {
+			borrowKey := rightSibling.keys[0]
+			borrowChild := rightSibling.children[0]
+			n.keys = append(n.keys, borrowKey)
+			n.children = append(n.children, borrowChild)
+			borrowChild.parent = n
+			parent.keys[index] = borrowKey
+			rightSibling.keys = rightSibling.keys[1:]
+			rightSibling.children = rightSibling.children[1:]
+			rightSibling.mu.Unlock()
+			return
+		}
+		rightSibling.mu.Unlock()
+	}
+	// 没借成功，合并
+	if index > 0 {
+		leftSibling := parent.children[index-1]
+		leftSibling.mu.Lock()
+		leftSibling.keys = append(leftSibling.keys, n.keys...)
+		leftSibling.children = append(leftSibling.children, n.children...)
+		for _, child := range n.children {
+			child.parent = leftSibling
+		}
+		leftSibling.mu.Unlock()
+		t.deleteFromParent(parent, index-1, index)
+	} else {
+		rightSibling := parent.children[index+1]
+		rightSibling.mu.Lock()
+		n.keys = append(n.keys, rightSibling.keys...)
+		n.children = append(n.children, rightSibling.children...)
+		for _, child := range rightSibling.children {
+			child.parent = n
+		}
+		rightSibling.mu.Unlock()
+		t.deleteFromParent(parent, index, index+1)
+	}
+	t.collapseRoot(parent)
+}
+
+// 处理根节点只剩一个子节点的情况，子节点成为新的根节点
+func (t *Tree[K, V]) collapseRoot(parent *node[K, V]) {
+	if parent.parent == nil && len(parent.children) == 1 {
+		t.root = parent.children[0]
+		t.root.parent = nil
+	}
+}
+
+// 从小到大遍历所有数据，fn返回false时停止
+func (t *Tree[K, V]) Ascend(fn func(key K, value V) bool) {
+	var zero K
+	t.ascend(zero, true, fn)
+}
+
+// 从pivot开始从小到大遍历不小于pivot的数据
+func (t *Tree[K, V]) AscendGreaterOrEqual(pivot K, fn func(key K, value V) bool) {
+	t.ascend(pivot, false, fn)
+}
+
+// 顺序遍历，迭代器每次复制一个叶子节点里的数据，fn在不持有锁的时候调用，所以fn里可以继续操作这棵树
+func (t *Tree[K, V]) ascend(pivot K, first bool, fn func(key K, value V) bool) {
+	it := t.Iter()
+	ok := false
+	if first {
+		ok = it.SeekFirst()
+	} else {
+		ok = it.Seek(pivot)
+	}
+	for ; ok; ok = it.Next() {
+		if !fn(it.Key(), it.Value()) {
+			return
+		}
+	}
+}
+
+// 从大到小遍历所有数据
+func (t *Tree[K, V]) Descend(fn func(key K, value V) bool) {
+	var zero K
+	t.descend(zero, true, fn)
+}
+
+// 从pivot开始从大到小遍历不大于pivot的数据
+func (t *Tree[K, V]) DescendLessOrEqual(pivot K, fn func(key K, value V) bool) {
+	t.descend(pivot, false, fn)
+}
+
+// 逆序遍历
+func (t *Tree[K, V]) descend(pivot K, last bool, fn func(key K, value V) bool) {
+	it := t.Iter()
+	ok := false
+	if last {
+		ok = it.SeekLast()
+	} else {
+		ok = it.SeekForPrev(pivot)
+	}
+	for ; ok; ok = it.Prev() {
+		if !fn(it.Key(), it.Value()) {
+			return
+		}
+	}
+}
+
+// 打印树，通过将每个节点添加到queue队列最后打印，调试用，不加锁
+func (t *Tree[K, V]) Print() {
+	if t.root == nil {
+		return
+	}
+	queue := []*node[K, V]{t.root}
+	for len(queue) > 0 {
+		levelSize := len(queue)
+		for i := 0; i < levelSize; i++ {
+			current := queue[0]
+			queue = queue[1:]
+			for _, k := range current.keys {
+				fmt.Print(k, " ")
+			}
+			if i < levelSize-1 {
+				fmt.Print(" ][")
+			}
+			if !current.leaf {
+				queue = append(queue, current.children...)
+			}
+		}
+		fmt.Println()
+	}
+}
+
+// 几个辅助函数，辅助插入和查找index操作
+func insertAt[T any](slice []T, index int, value T) []T {
+	var zero T
+	slice = append(slice, zero)
+	copy(slice[index+1:], slice[index:])
+	slice[index] = value
+	return slice
+}
+
+func removeAt[T any](slice []T, index int) []T {
+	return append(slice[:index], slice[index+1:]...)
+}
+
+func getNodeIndex[K cmp.Ordered, V any](parent *node[K, V], n *node[K, V]) int {
+	for i, child := range parent.children {
+		if child == n {
+			return i
+		}
+	}
+	return -1
+}
+
+// 内部节点中key应该进入的子节点，大于所有key时进入最后一个子节点
+func childIndex[K cmp.Ordered, V any](n *node[K, V], key K) int {
+	index := findIndex(n.keys, key)
+	if index >= len(n.children) {
+		index = len(n.children) - 1
+	}
+	return index
+}
+
+// 二分查找第一个不小于key的位置
+func findIndex[K cmp.Ordered](keys []K, key K) int {
+	return sort.Search(len(keys), func(i int) bool { return keys[i] >= key })
+}
+
+// strict为true时查找第一个大于key的位置，否则查找第一个不小于key的位置
+func seekIndex[K cmp.Ordered](keys []K, key K, strict bool) int {
+	if !strict {
+		return findIndex(keys, key)
+	}
+	return sort.Search(len(keys), func(i int) bool { return keys[i] > key })
+}
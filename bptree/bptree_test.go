@@ -0,0 +1,134 @@
+package bptree_test
+
+import (
+	"math/rand"
+	"slices"
+	"sort"
+	"sync"
+	"testing"
+	"wr_2/bptree"
+)
+
+// 随机插入和删除，和map的结果比较，每隔一段检查一次所有遍历方式
+func TestRandomAgainstMap(t *testing.T) {
+	seeds := int64(20)
+	if testing.Short() {
+		seeds = 3
+	}
+	for _, order := range []int{4, 5, 7, 16} {
+		for seed := int64(0); seed < seeds; seed++ {
+			r := rand.New(rand.NewSource(seed))
+			tr := bptree.New[int, int](order)
+			ref := map[int]int{}
+			for i := 0; i < 3000; i++ {
+				k := r.Intn(500)
+				if r.Intn(3) < 2 {
+					old, replaced := tr.Put(k, i)
+					if want, ok := ref[k]; replaced != ok || old != want {
+						t.Fatalf("order %d seed %d: Put(%d) = %d, %v, want %d, %v", order, seed, k, old, replaced, want, ok)
+					}
+					ref[k] = i
+				} else {
+					old, deleted := tr.Delete(k)
+					if want, ok := ref[k]; deleted != ok || old != want {
+						t.Fatalf("order %d seed %d: Delete(%d) = %d, %v, want %d, %v", order, seed, k, old, deleted, want, ok)
+					}
+					delete(ref, k)
+				}
+				if i%50 == 0 {
+					checkTree(t, tr, ref, r)
+				}
+			}
+			checkTree(t, tr, ref, r)
+		}
+	}
+}
+
+// 检查树的结构、数量、正序倒序遍历、从任意位置开始的遍历和最大最小值
+func checkTree(t *testing.T, tr *bptree.Tree[int, int], ref map[int]int, r *rand.Rand) {
+	t.Helper()
+	if err := tr.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	keys := make([]int, 0, len(ref))
+	for k := range ref {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	if tr.Len() != len(keys) {
+		t.Fatalf("Len = %d, want %d", tr.Len(), len(keys))
+	}
+	var got []int
+	tr.Ascend(func(k, v int) bool {
+		if ref[k] != v {
+			t.Fatalf("Ascend: %d = %d, want %d", k, v, ref[k])
+		}
+		got = append(got, k)
+		return true
+	})
+	if !slices.Equal(got, keys) {
+		t.Fatalf("Ascend = %v, want %v", got, keys)
+	}
+	reversed := slices.Clone(keys)
+	slices.Reverse(reversed)
+	got = nil
+	tr.Descend(func(k, v int) bool { got = append(got, k); return true })
+	if !slices.Equal(got, reversed) {
+		t.Fatalf("Descend = %v, want %v", got, reversed)
+	}
+	for n := 0; n < 10; n++ {
+		pivot := r.Intn(520) - 10
+		got = nil
+		tr.AscendGreaterOrEqual(pivot, func(k, v int) bool { got = append(got, k); return true })
+		if want := keys[sort.SearchInts(keys, pivot):]; !slices.Equal(got, want) {
+			t.Fatalf("AscendGreaterOrEqual(%d) = %v, want %v", pivot, got, want)
+		}
+		got = nil
+		tr.DescendLessOrEqual(pivot, func(k, v int) bool { got = append(got, k); return true })
+		if want := reversed[len(keys)-sort.SearchInts(keys, pivot+1):]; !slices.Equal(got, want) {
+			t.Fatalf("DescendLessOrEqual(%d) = %v, want %v", pivot, got, want)
+		}
+	}
+	minKey, _, ok := tr.Min()
+	maxKey, _, ok2 := tr.Max()
+	if ok != (len(keys) > 0) || ok2 != ok || (ok && (minKey != keys[0] || maxKey != keys[len(keys)-1])) {
+		t.Fatalf("Min = %d, %v, Max = %d, %v, keys %v", minKey, ok, maxKey, ok2, keys)
+	}
+}
+
+// 多个goroutine同时读写，倒序遍历看到的key必须严格递减，用go test -race检查锁耦合
+func TestConcurrentReadWrite(t *testing.T) {
+	tr := bptree.New[int, int](4)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(int64(g)))
+			for i := 0; i < 20000; i++ {
+				k := r.Intn(1000)
+				switch r.Intn(5) {
+				case 0, 1:
+					tr.Put(k, i)
+				case 2:
+					tr.Delete(k)
+				case 3:
+					tr.Get(k)
+				case 4:
+					prev := 1 << 30
+					tr.DescendLessOrEqual(k, func(k, v int) bool {
+						if k >= prev {
+							t.Errorf("DescendLessOrEqual: %d after %d", k, prev)
+						}
+						prev = k
+						return r.Intn(50) > 0
+					})
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	if err := tr.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,129 @@
+package bptree
+
+import "cmp"
+
+// 双向迭代器，每次加读锁复制一个叶子节点的数据，两次调用之间不持有任何锁
+// 走到复制的数据末尾时，如果原来的叶子节点没有变化，就沿着next或prev指针直接读相邻的叶子节点，
+// 写操作加锁的顺序是从上到下、兄弟节点之间可能是任意方向，所以这里对相邻节点只用TryRLock，拿不到锁或者节点已经变化就从根节点重新查找
+// 遍历开始前就存在、遍历过程中一直没有被删除的key一定会按顺序被访问且只访问一次，遍历过程中插入的key不保证能看到
+type Iterator[K cmp.Ordered, V any] struct {
+	t       *Tree[K, V]
+	leaf    *node[K, V] // 当前数据复制自哪个叶子节点
+	version uint64      // 复制时叶子节点的版本
+	keys    []K
+	values  []V
+	pos     int
+}
+
+// 创建迭代器，需要先调用Seek系列方法定位
+func (t *Tree[K, V]) Iter() *Iterator[K, V] {
+	return &Iterator[K, V]{t: t}
+}
+
+// 迭代器是否指向一条数据
+func (it *Iterator[K, V]) Valid() bool {
+	return it.pos >= 0 && it.pos < len(it.keys)
+}
+
+// 当前数据的key，只有Valid时才有意义
+func (it *Iterator[K, V]) Key() K {
+	return it.keys[it.pos]
+}
+
+// 当前数据的value，只有Valid时才有意义
+func (it *Iterator[K, V]) Value() V {
+	return it.values[it.pos]
+}
+
+// 定位到第一个不小于key的数据
+func (it *Iterator[K, V]) Seek(key K) bool {
+	leaf, index := it.t.seekLeaf(key, false, false)
+	return it.load(leaf, index)
+}
+
+// 定位到最后一个不大于key的数据
+func (it *Iterator[K, V]) SeekForPrev(key K) bool {
+	leaf, index := it.t.seekLeafReverse(key, false, false)
+	return it.load(leaf, index)
+}
+
+// 定位到最小的数据
+func (it *Iterator[K, V]) SeekFirst() bool {
+	var zero K
+	leaf, index := it.t.seekLeaf(zero, false, true)
+	return it.load(leaf, index)
+}
+
+// 定位到最大的数据
+func (it *Iterator[K, V]) SeekLast() bool {
+	var zero K
+	leaf, index := it.t.seekLeafReverse(zero, false, true)
+	return it.load(leaf, index)
+}
+
+// 移动到下一条数据，没有时返回false，迭代器失效
+func (it *Iterator[K, V]) Next() bool {
+	if !it.Valid() {
+		return false
+	}
+	it.pos++
+	if it.pos < len(it.keys) {
+		return true
+	}
+	last := it.keys[len(it.keys)-1]
+	leaf := it.leaf
+	leaf.mu.RLock()
+	if leaf.version == it.version {
+		next := leaf.next
+		if next == nil {
+			leaf.mu.RUnlock()
+			return it.load(nil, 0)
+		}
+		if next.mu.TryRLock() {
+			leaf.mu.RUnlock()
+			return it.load(next, 0)
+		}
+	}
+	leaf.mu.RUnlock()
+	return it.load(it.t.seekLeaf(last, true, false))
+}
+
+// 移动到上一条数据，没有时返回false，迭代器失效
+func (it *Iterator[K, V]) Prev() bool {
+	if !it.Valid() {
+		return false
+	}
+	it.pos--
+	if it.pos >= 0 {
+		return true
+	}
+	first := it.keys[0]
+	leaf := it.leaf
+	leaf.mu.RLock()
+	if leaf.version == it.version {
+		if prev := leaf.prev.Load(); prev != nil && prev.mu.TryRLock() {
+			if prev.next == leaf {
+				leaf.mu.RUnlock()
+				return it.load(prev, len(prev.keys)-1)
+			}
+			prev.mu.RUnlock()
+		}
+	}
+	leaf.mu.RUnlock()
+	return it.load(it.t.seekLeafReverse(first, true, false))
+}
+
+// 复制持有读锁的叶子节点的数据并释放锁，leaf为nil时迭代器失效
+func (it *Iterator[K, V]) load(leaf *node[K, V], index int) bool {
+	if leaf == nil {
+		it.leaf, it.keys, it.values, it.pos = nil, nil, nil, 0
+		return false
+	}
+	it.leaf = leaf
+	it.version = leaf.version
+	it.keys = append(it.keys[:0], leaf.keys...)
+	it.values = append(it.values[:0], leaf.values...)
+	it.pos = index
+	leaf.mu.RUnlock()
+	return true
+}
@@ -0,0 +1,125 @@
+package bptree_test
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"wr_2/bptree"
+)
+
+// 后台不停插入删除其他key时，遍历必须有序，并且每次都能看到所有没有被修改过的key
+func TestIterateDuringWrites(t *testing.T) {
+	for round := 0; round < 5; round++ {
+		iterateDuringWrites(t, int64(round))
+	}
+}
+
+func iterateDuringWrites(t *testing.T, seed int64) {
+	tr := bptree.New[int, int](4)
+	// 10的倍数是不会被修改的key
+	for k := 0; k < 5000; k += 10 {
+		tr.Put(k, k)
+	}
+	var stop atomic.Bool
+	var wg sync.WaitGroup
+	// t.Fatal之前也要停止后台写入，不影响后面的测试
+	defer wg.Wait()
+	defer stop.Store(true)
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(seed*10 + int64(g)))
+			for !stop.Load() {
+				k := r.Intn(5000)
+				if k%10 == 0 {
+					continue
+				}
+				if r.Intn(2) == 0 {
+					tr.Put(k, k)
+				} else {
+					tr.Delete(k)
+				}
+			}
+		}(g)
+	}
+	for i := 0; i < 200; i++ {
+		seen, prev := 0, -1
+		tr.Ascend(func(k, v int) bool {
+			if k <= prev {
+				t.Fatalf("Ascend: %d after %d", k, prev)
+			}
+			prev = k
+			if k%10 == 0 {
+				seen++
+			}
+			return true
+		})
+		if seen != 500 {
+			t.Fatalf("Ascend saw %d stable keys, want 500", seen)
+		}
+		seen, prev = 0, 1<<30
+		tr.Descend(func(k, v int) bool {
+			if k >= prev {
+				t.Fatalf("Descend: %d after %d", k, prev)
+			}
+			prev = k
+			if k%10 == 0 {
+				seen++
+			}
+			return true
+		})
+		if seen != 500 {
+			t.Fatalf("Descend saw %d stable keys, want 500", seen)
+		}
+		// 迭代器前进后再往回走，一定会经过起点这个不变的key，不会跳过它
+		it := tr.Iter()
+		if it.Seek(2500) {
+			start := it.Key()
+			for j := 0; j < 30 && it.Next(); j++ {
+			}
+			for it.Valid() && it.Key() > start {
+				it.Prev()
+			}
+			if !it.Valid() || it.Key() != start {
+				t.Fatalf("Prev from after %d skipped it", start)
+			}
+		}
+	}
+}
+
+// 并发写入和迭代器倒序遍历时检查结构，Validate和Dump会锁住整棵树
+func TestValidateDuringWrites(t *testing.T) {
+	tr := bptree.New[int, int](4)
+	var stop atomic.Bool
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer stop.Store(true)
+	for g := 0; g < 6; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(int64(g)))
+			for !stop.Load() {
+				k := r.Intn(3000)
+				switch r.Intn(4) {
+				case 0, 1:
+					tr.Put(k, k)
+				case 2:
+					tr.Delete(k)
+				case 3:
+					it := tr.Iter()
+					for ok := it.SeekForPrev(k); ok && r.Intn(20) > 0; ok = it.Prev() {
+					}
+				}
+			}
+		}(g)
+	}
+	for i := 0; i < 300; i++ {
+		if err := tr.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		tr.Dump(2)
+	}
+}
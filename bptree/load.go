@@ -0,0 +1,91 @@
+package bptree
+
+import (
+	"cmp"
+	"fmt"
+	"iter"
+)
+
+// 从按key严格递增的数据流自底向上批量构建树，叶子节点和内部节点都尽量填满，
+// 不会像逐条插入那样不断分裂，数据流不是严格递增时返回错误
+// 构建完成之前树不会被其他操作访问，所以整个过程不加锁
+func Load[K cmp.Ordered, V any](order int, seq iter.Seq2[K, V]) (*Tree[K, V], error) {
+	t := New[K, V](order)
+	var leaves []*node[K, V]
+	var current *node[K, V]
+	var last K
+	count := 0
+	for k, v := range seq {
+		if count > 0 && k <= last {
+			return nil, fmt.Errorf("bptree: keys must be strictly ascending, got %v after %v", k, last)
+		}
+		last = k
+		count++
+		if current == nil || len(current.keys) == t.maxLen {
+			n := &node[K, V]{
+				keys:   make([]K, 0, t.maxLen),
+				values: make([]V, 0, t.maxLen),
+				leaf:   true,
+			}
+			if current != nil {
+				current.next = n
+				n.prev.Store(current)
+			}
+			leaves = append(leaves, n)
+			current = n
+		}
+		current.keys = append(current.keys, k)
+		current.values = append(current.values, v)
+	}
+	if count == 0 {
+		return t, nil
+	}
+	// 最后一个叶子节点不够最小长度时，从前一个叶子节点分一半过来
+	if n := len(leaves); n > 1 && len(leaves[n-1].keys) < t.leastLen {
+		prev, tail := leaves[n-2], leaves[n-1]
+		cut := len(prev.keys) - (len(prev.keys)-len(tail.keys))/2
+		tail.keys = append(append([]K(nil), prev.keys[cut:]...), tail.keys...)
+		tail.values = append(append([]V(nil), prev.values[cut:]...), tail.values...)
+		prev.keys = prev.keys[:cut]
+		prev.values = prev.values[:cut]
+	}
+
+	level := leaves
+	for len(level) > 1 {
+		var parents []*node[K, V]
+		start := 0
+		for _, size := range t.chunkSizes(len(level)) {
+			parent := &node[K, V]{
+				keys:     make([]K, 0, size),
+				children: make([]*node[K, V], 0, size),
+			}
+			for _, child := range level[start : start+size] {
+				child.parent = parent
+				parent.keys = append(parent.keys, child.keys[len(child.keys)-1])
+				parent.children = append(parent.children, child)
+			}
+			parents = append(parents, parent)
+			start += size
+		}
+		level = parents
+	}
+	t.root = level[0]
+	t.size.Store(int64(count))
+	return t, nil
+}
+
+// 把n个子节点分给若干个父节点，每个父节点尽量填满，最后两个父节点平分，保证都不小于最小长度
+func (t *Tree[K, V]) chunkSizes(n int) []int {
+	var sizes []int
+	for n > t.maxLen {
+		sizes = append(sizes, t.maxLen)
+		n -= t.maxLen
+	}
+	sizes = append(sizes, n)
+	if last := len(sizes) - 1; last > 0 && n < t.leastLen {
+		total := sizes[last-1] + n
+		sizes[last-1] = total - total/2
+		sizes[last] = total / 2
+	}
+	return sizes
+}
@@ -0,0 +1,85 @@
+package bptree_test
+
+import (
+	"iter"
+	"math/rand"
+	"testing"
+	"wr_2/bptree"
+)
+
+// n条有序数据，key是0、2、4...
+func evenKeys(n int) iter.Seq2[int, int] {
+	return func(yield func(int, int) bool) {
+		for i := 0; i < n; i++ {
+			if !yield(i*2, i) {
+				return
+			}
+		}
+	}
+}
+
+// 批量构建各种大小的树，构建后的树可以正常插入和删除
+func TestLoad(t *testing.T) {
+	for _, order := range []int{4, 5, 6, 7, 64} {
+		for n := 0; n < 300; n++ {
+			tr, err := bptree.Load(order, evenKeys(n))
+			if err != nil {
+				t.Fatal(err)
+			}
+			ref := map[int]int{}
+			for i := 0; i < n; i++ {
+				ref[i*2] = i
+			}
+			r := rand.New(rand.NewSource(int64(n)))
+			checkTree(t, tr, ref, r)
+			for i := 0; i < 500; i++ {
+				k := r.Intn(2*n + 10)
+				if r.Intn(2) == 0 {
+					tr.Put(k, i)
+					ref[k] = i
+				} else {
+					tr.Delete(k)
+					delete(ref, k)
+				}
+			}
+			checkTree(t, tr, ref, r)
+		}
+	}
+}
+
+func TestLoadRejectsDuplicates(t *testing.T) {
+	_, err := bptree.Load(4, func(yield func(int, int) bool) {
+		yield(1, 1)
+		yield(1, 2)
+	})
+	if err == nil {
+		t.Fatal("Load accepted a duplicate key")
+	}
+}
+
+// 每一次插入和删除之后结构都必须正确
+func TestValidateAfterEveryWrite(t *testing.T) {
+	for _, order := range []int{4, 5, 9} {
+		for n := 0; n < 200; n += 23 {
+			tr, err := bptree.Load(order, evenKeys(n))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := tr.Validate(); err != nil {
+				t.Fatalf("order %d, %d keys loaded: %v", order, n, err)
+			}
+			r := rand.New(rand.NewSource(int64(n)))
+			for i := 0; i < 1000; i++ {
+				k := r.Intn(400)
+				if r.Intn(2) == 0 {
+					tr.Put(k, i)
+				} else {
+					tr.Delete(k)
+				}
+				if err := tr.Validate(); err != nil {
+					t.Fatalf("order %d, %d keys loaded, op %d: %v", order, n, i, err)
+				}
+			}
+		}
+	}
+}
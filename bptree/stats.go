@@ -0,0 +1,43 @@
+package bptree
+
+// 树的统计信息，用来调整阶数
+type Stats struct {
+	Order      int
+	Height     int
+	Nodes      int
+	Leaves     int
+	Keys       int
+	FillFactor float64 // 所有节点的key数量之和 / (节点数 * 阶数)
+}
+
+// 统计树的高度、节点数和填充率
+// 每次只对一个节点加读锁，复制子节点列表之后就释放，所以并发写入时得到的是近似值
+func (t *Tree[K, V]) Stats() Stats {
+	s := Stats{Order: t.maxLen, Keys: t.Len()}
+	t.rootMu.RLock()
+	root := t.root
+	t.rootMu.RUnlock()
+	if root == nil {
+		return s
+	}
+	used := 0
+	level := []*node[K, V]{root}
+	for len(level) > 0 {
+		s.Height++
+		var next []*node[K, V]
+		for _, n := range level {
+			n.mu.RLock()
+			used += len(n.keys)
+			if n.leaf {
+				s.Leaves++
+			} else {
+				next = append(next, n.children...)
+			}
+			n.mu.RUnlock()
+		}
+		s.Nodes += len(level)
+		level = next
+	}
+	s.FillFactor = float64(used) / float64(s.Nodes*t.maxLen)
+	return s
+}
@@ -0,0 +1,157 @@
+package bptree
+
+import (
+	"cmp"
+	"fmt"
+)
+
+// 一个节点的结构，调试用
+type NodeInfo[K cmp.Ordered] struct {
+	Keys []K
+	Leaf bool
+}
+
+// 从上往下按层对所有节点加读锁，fn返回后全部释放
+// 持有rootMu的读锁，新的写操作进不来，正在进行的写操作持有的节点要等它完成才能拿到，
+// 加锁顺序和写操作一样是从父节点到子节点，不会死锁，fn执行期间整棵树不会变化
+func (t *Tree[K, V]) withLevels(fn func(levels [][]*node[K, V])) {
+	t.rootMu.RLock()
+	defer t.rootMu.RUnlock()
+	var levels [][]*node[K, V]
+	if t.root != nil {
+		t.root.mu.RLock()
+		level := []*node[K, V]{t.root}
+		for len(level) > 0 {
+			levels = append(levels, level)
+			var next []*node[K, V]
+			for _, n := range level {
+				for _, child := range n.children {
+					child.mu.RLock()
+					next = append(next, child)
+				}
+			}
+			level = next
+		}
+	}
+	defer func() {
+		for _, level := range levels {
+			for _, n := range level {
+				n.mu.RUnlock()
+			}
+		}
+	}()
+	fn(levels)
+}
+
+// 按层返回每个节点的key，maxLevels大于0时只返回最上面的maxLevels层
+func (t *Tree[K, V]) Dump(maxLevels int) [][]NodeInfo[K] {
+	var result [][]NodeInfo[K]
+	t.withLevels(func(levels [][]*node[K, V]) {
+		for i, level := range levels {
+			if maxLevels > 0 && i >= maxLevels {
+				break
+			}
+			infos := make([]NodeInfo[K], 0, len(level))
+			for _, n := range level {
+				infos = append(infos, NodeInfo[K]{Keys: append([]K(nil), n.keys...), Leaf: n.leaf})
+			}
+			result = append(result, infos)
+		}
+	})
+	return result
+}
+
+// 检查树的结构是否正确，返回第一个发现的问题，正确时返回nil
+// 检查内容：节点内key严格递增、节点长度在最小和最大长度之间、父节点指针、内部节点的key等于子节点的最大值、
+// 所有叶子节点在同一层、叶子节点的next和prev链表和按层遍历的顺序一致、叶子之间key递增、数据数量和Len一致
+func (t *Tree[K, V]) Validate() error {
+	var err error
+	t.withLevels(func(levels [][]*node[K, V]) {
+		err = t.validate(levels)
+	})
+	return err
+}
+
+func (t *Tree[K, V]) validate(levels [][]*node[K, V]) error {
+	if len(levels) == 0 {
+		if n := t.Len(); n != 0 {
+			return fmt.Errorf("empty tree has length %d", n)
+		}
+		return nil
+	}
+	root := levels[0][0]
+	if root.parent != nil {
+		return fmt.Errorf("root has a parent")
+	}
+	if len(root.keys) == 0 {
+		return fmt.Errorf("root is empty")
+	}
+	if !root.leaf && len(root.children) < 2 {
+		return fmt.Errorf("internal root has %d children", len(root.children))
+	}
+	for depth, level := range levels {
+		isLeafLevel := depth == len(levels)-1
+		for i, n := range level {
+			where := fmt.Sprintf("level %d node %d", depth, i)
+			if n.leaf != isLeafLevel {
+				return fmt.Errorf("%s: leaf flag is %v, leaves must all be on level %d", where, n.leaf, len(levels)-1)
+			}
+			if len(n.keys) > t.maxLen {
+				return fmt.Errorf("%s: %d keys exceeds order %d", where, len(n.keys), t.maxLen)
+			}
+			if n != root && len(n.keys) < t.leastLen {
+				return fmt.Errorf("%s: %d keys is below minimum %d", where, len(n.keys), t.leastLen)
+			}
+			for j := 1; j < len(n.keys); j++ {
+				if n.keys[j-1] >= n.keys[j] {
+					return fmt.Errorf("%s: keys not ascending at %d: %v >= %v", where, j, n.keys[j-1], n.keys[j])
+				}
+			}
+			if n.leaf {
+				if len(n.values) != len(n.keys) {
+					return fmt.Errorf("%s: %d values for %d keys", where, len(n.values), len(n.keys))
+				}
+				if len(n.children) != 0 {
+					return fmt.Errorf("%s: leaf has %d children", where, len(n.children))
+				}
+				continue
+			}
+			if len(n.children) != len(n.keys) {
+				return fmt.Errorf("%s: %d children for %d keys", where, len(n.children), len(n.keys))
+			}
+			for j, child := range n.children {
+				if child.parent != n {
+					return fmt.Errorf("%s: child %d has wrong parent pointer", where, j)
+				}
+				if len(child.keys) == 0 || child.keys[len(child.keys)-1] != n.keys[j] {
+					return fmt.Errorf("%s: separator %v does not match max key of child %d", where, n.keys[j], j)
+				}
+			}
+		}
+	}
+	leaves := levels[len(levels)-1]
+	count := 0
+	for i, leaf := range leaves {
+		count += len(leaf.keys)
+		var wantNext, wantPrev *node[K, V]
+		if i+1 < len(leaves) {
+			wantNext = leaves[i+1]
+			if leaf.keys[len(leaf.keys)-1] >= wantNext.keys[0] {
+				return fmt.Errorf("leaf %d: max key %v is not below next leaf's min key %v", i, leaf.keys[len(leaf.keys)-1], wantNext.keys[0])
+			}
+		}
+		if i > 0 {
+			wantPrev = leaves[i-1]
+		}
+		if leaf.next != wantNext {
+			return fmt.Errorf("leaf %d: next pointer does not point to the following leaf", i)
+		}
+		if leaf.prev.Load() != wantPrev {
+			return fmt.Errorf("leaf %d: prev pointer does not point to the preceding leaf", i)
+		}
+	}
+	if count != t.Len() {
+		return fmt.Errorf("leaves hold %d keys but length is %d", count, t.Len())
+	}
+	return nil
+}
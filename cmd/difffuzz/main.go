@@ -0,0 +1,33 @@
+// 持续生成随机输入运行差分测试，发现不一致时打印最短复现序列并退出
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"time"
+	"wr_2/difftest"
+)
+
+func main() {
+	duration := flag.Duration("d", time.Minute, "how long to run")
+	maxOps := flag.Int("ops", 2000, "max operations per input")
+	seed := flag.Int64("seed", time.Now().UnixNano(), "random seed")
+	flag.Parse()
+
+	r := rand.New(rand.NewSource(*seed))
+	deadline := time.Now().Add(*duration)
+	runs := 0
+	for time.Now().Before(deadline) {
+		data := make([]byte, 2*(1+r.Intn(*maxOps)))
+		r.Read(data)
+		if err := difftest.Check(data); err != nil {
+			fmt.Printf("seed %d run %d\n%v", *seed, runs, err)
+			os.Exit(1)
+		}
+		runs++
+	}
+	fmt.Printf("seed %d: %d runs passed\n", *seed, runs)
+}
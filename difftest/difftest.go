@@ -0,0 +1,235 @@
+// 差分测试：把同一串随机操作同时作用在每个DataStruct实现和一个参考的map上，比较每一步的结果
+// 发现不一致时缩减操作序列，报告仍然能复现问题的最短序列
+//
+// 输入是任意字节串，每两个字节解码成一个操作，所以可以直接接到go原生的模糊测试上，见difftest_test.go中的FuzzEngines：
+//
+//	go test ./difftest -fuzz FuzzEngines
+//
+// 也可以用cmd/difffuzz生成随机输入持续运行
+
+package difftest
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"wr_2/model"
+)
+
+type OpKind byte
+
+const (
+	OpPut OpKind = iota
+	OpDelete
+	OpGet
+	OpLen
+	OpGossipUpdate
+	opKinds
+)
+
+var opNames = [...]string{"Put", "Delete", "Get", "Len", "GossipUpdate"}
+
+func (k OpKind) String() string {
+	return opNames[k]
+}
+
+// 一个操作，Key和Value只对需要的操作有意义
+type Op struct {
+	Kind  OpKind
+	Key   string
+	Value int
+}
+
+func (o Op) String() string {
+	switch o.Kind {
+	case OpPut:
+		return fmt.Sprintf("Put(%q, %d)", o.Key, o.Value)
+	case OpDelete, OpGet:
+		return fmt.Sprintf("%s(%q)", o.Kind, o.Key)
+	default:
+		return o.Kind.String() + "()"
+	}
+}
+
+// 每两个字节解码成一个操作，第一个字节决定操作类型，第二个字节决定key，插入的值是操作的序号
+// key只有256个，保证删除和查找经常能命中，同时足够让B+树分裂和合并好几层
+func Decode(data []byte) []Op {
+	ops := make([]Op, 0, len(data)/2)
+	for i := 0; i+1 < len(data); i += 2 {
+		ops = append(ops, Op{
+			Kind:  OpKind(data[i] % byte(opKinds)),
+			Key:   fmt.Sprintf("k%d", data[i+1]),
+			Value: i / 2,
+		})
+	}
+	return ops
+}
+
+// 用每个注册的引擎执行data解码出的操作，引擎使用默认配置，发现不一致时返回包含最短复现序列的错误
+func Check(data []byte) error {
+	ops := Decode(data)
+	for _, name := range model.Engines() {
+		newDS := func() model.DataStruct {
+			ds, err := model.Open(name, model.NoConfig)
+			if err != nil {
+				panic(err)
+			}
+			return ds
+		}
+		if Run(newDS(), ops) == nil {
+			continue
+		}
+		minimal := Minimize(newDS, ops)
+		return fmt.Errorf("%s: %v\nminimal sequence (%d of %d ops):\n%s", name, Run(newDS(), minimal), len(minimal), len(ops), Format(minimal))
+	}
+	return nil
+}
+
+// 每行一个操作
+func Format(ops []Op) string {
+	var b strings.Builder
+	for i, op := range ops {
+		fmt.Fprintf(&b, "%4d  %s\n", i, op)
+	}
+	return b.String()
+}
+
+// 参考模型中的一条数据，dirty表示上次GossipUpdate之后被写过
+type refEntry struct {
+	value int
+	dirty bool
+}
+
+// 在ds上执行ops，每一步都和参考模型比较，返回第一处不一致
+// 执行完之后再检查一次顺序遍历的结果，实现了Validate的数据结构还会检查内部结构，最后关闭ds
+func Run(ds model.DataStruct, ops []Op) error {
+	defer ds.Close()
+	ref := map[string]*refEntry{}
+	for i, op := range ops {
+		if err := step(ds, ref, op); err != nil {
+			return fmt.Errorf("op %d %s: %v", i, op, err)
+		}
+		if v, ok := ds.(interface{ Validate() error }); ok {
+			if err := v.Validate(); err != nil {
+				return fmt.Errorf("op %d %s: invalid structure: %v", i, op, err)
+			}
+		}
+	}
+	return checkOrder(ds, ref)
+}
+
+func step(ds model.DataStruct, ref map[string]*refEntry, op Op) error {
+	switch op.Kind {
+	case OpPut:
+		d, err := ds.Put(op.Key, op.Value, 0)
+		if err != nil {
+			return err
+		}
+		if d == nil || d.OriginKey != op.Key || d.Value != op.Value {
+			return fmt.Errorf("returned %s", describe(d))
+		}
+		ref[op.Key] = &refEntry{value: op.Value, dirty: true}
+	case OpDelete:
+		_, want := ref[op.Key]
+		err := ds.Delete(op.Key)
+		if err != nil && !errors.Is(err, model.ErrNotFound) {
+			return err
+		}
+		if got := err == nil; got != want {
+			return fmt.Errorf("got %v, want %v", got, want)
+		}
+		delete(ref, op.Key)
+	case OpGet:
+		d, err := ds.Get(op.Key)
+		if err != nil && !errors.Is(err, model.ErrNotFound) {
+			return err
+		}
+		ok := err == nil
+		e, want := ref[op.Key]
+		if ok != want {
+			return fmt.Errorf("found %v, want %v", ok, want)
+		}
+		if ok && (d == nil || d.OriginKey != op.Key || d.Value != e.value) {
+			return fmt.Errorf("got %s, want value %d", describe(d), e.value)
+		}
+	case OpLen:
+		if got := ds.Len(); got != len(ref) {
+			return fmt.Errorf("got %d, want %d", got, len(ref))
+		}
+	case OpGossipUpdate:
+		got := map[string]interface{}{}
+		for _, g := range ds.GossipUpdate() {
+			if _, dup := got[g.Key]; dup {
+				return fmt.Errorf("key %q reported twice", g.Key)
+			}
+			got[g.Key] = g.Value
+		}
+		want := map[string]interface{}{}
+		for k, e := range ref {
+			if e.dirty {
+				want[k] = e.value
+				e.dirty = false
+			}
+		}
+		if !sameMap(got, want) {
+			return fmt.Errorf("got %v, want %v", got, want)
+		}
+	}
+	return nil
+}
+
+// 顺序遍历的结果必须是参考模型中的所有key按字典序排列
+func checkOrder(ds model.DataStruct, ref map[string]*refEntry) error {
+	want := make([]string, 0, len(ref))
+	for k := range ref {
+		want = append(want, k)
+	}
+	sort.Strings(want)
+	var got []string
+	err := ds.Iterate(func(d *model.DataPair) bool {
+		got = append(got, d.OriginKey)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		return fmt.Errorf("Ascend returned %v, want %v", got, want)
+	}
+	return nil
+}
+
+func describe(d *model.DataPair) string {
+	if d == nil {
+		return "nil"
+	}
+	return fmt.Sprintf("{%q: %v}", d.OriginKey, d.Value)
+}
+
+func sameMap(a, b map[string]interface{}) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || w != v {
+			return false
+		}
+	}
+	return true
+}
+
+// 缩减失败的操作序列：依次尝试删掉一段连续的操作，删掉之后仍然失败就保留删除，段长度从一半逐步减到1
+func Minimize(newDS func() model.DataStruct, ops []Op) []Op {
+	for chunk := len(ops) / 2; chunk >= 1; chunk /= 2 {
+		for i := 0; i+chunk <= len(ops); {
+			candidate := append(append([]Op(nil), ops[:i]...), ops[i+chunk:]...)
+			if Run(newDS(), candidate) != nil {
+				ops = candidate
+			} else {
+				i += chunk
+			}
+		}
+	}
+	return ops
+}
@@ -0,0 +1,58 @@
+package difftest_test
+
+import (
+	"testing"
+	"wr_2/difftest"
+)
+
+// 按操作类型和key拼出输入，每两个字节一个操作
+func ops(kind difftest.OpKind, keys ...byte) []byte {
+	data := make([]byte, 0, 2*len(keys))
+	for _, k := range keys {
+		data = append(data, byte(kind), k)
+	}
+	return data
+}
+
+func keyRange(from, to int) []byte {
+	keys := make([]byte, 0, to-from)
+	for k := from; k < to; k++ {
+		keys = append(keys, byte(k))
+	}
+	return keys
+}
+
+func join(parts ...[]byte) []byte {
+	var data []byte
+	for _, p := range parts {
+		data = append(data, p...)
+	}
+	return data
+}
+
+func FuzzEngines(f *testing.F) {
+	all := keyRange(0, 256)
+	// 写入全部256个key，B+树分裂好几层，Map中有很多hash冲突的key
+	f.Add(join(ops(difftest.OpPut, all...), ops(difftest.OpGet, all...), ops(difftest.OpLen, 0)))
+	// 写满之后倒序删除，B+树逐层合并到只剩根节点
+	reversed := make([]byte, len(all))
+	for i, k := range all {
+		reversed[len(all)-1-i] = k
+	}
+	f.Add(join(ops(difftest.OpPut, all...), ops(difftest.OpDelete, reversed...), ops(difftest.OpLen, 0), ops(difftest.OpGet, 7, 200)))
+	// 删除和查找不存在的key，重复写入同一个key
+	f.Add(join(ops(difftest.OpDelete, 1, 2), ops(difftest.OpGet, 1), ops(difftest.OpPut, 1, 1, 1), ops(difftest.OpLen, 0), ops(difftest.OpDelete, 1, 1)))
+	// GossipUpdate只返回上一次之后写入的key
+	f.Add(join(ops(difftest.OpPut, keyRange(0, 64)...), ops(difftest.OpGossipUpdate, 0), ops(difftest.OpPut, 3, 40), ops(difftest.OpDelete, 5), ops(difftest.OpGossipUpdate, 0, 0)))
+	// 删除一半之后再写回来
+	f.Add(join(ops(difftest.OpPut, keyRange(0, 128)...), ops(difftest.OpDelete, keyRange(32, 96)...), ops(difftest.OpPut, keyRange(64, 160)...), ops(difftest.OpGet, keyRange(0, 160)...)))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		// 每一步之后都要检查树的结构，输入太长时一次要跑很久，截断到2000个操作
+		if len(data) > 4000 {
+			data = data[:4000]
+		}
+		if err := difftest.Check(data); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
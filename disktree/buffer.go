@@ -0,0 +1,134 @@
+package disktree
+
+import (
+	"container/list"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+// 页缓存，按LRU淘汰，被修改过的页在淘汰或者flush时才写回文件
+// 读取返回的切片在缓存中不会被原地修改，写入总是替换成新的切片，所以调用方拿到之后可以在不加锁的情况下解码
+type bufferPool struct {
+	mu       sync.Mutex
+	f        *os.File
+	capacity int
+	frames   map[uint32]*list.Element
+	lru      *list.List // 前面是最近使用的
+
+	hits, misses, evictions, writes uint64
+}
+
+type frame struct {
+	id    uint32
+	data  []byte
+	dirty bool
+}
+
+func newBufferPool(f *os.File, capacity int) *bufferPool {
+	return &bufferPool{f: f, capacity: capacity, frames: make(map[uint32]*list.Element), lru: list.New()}
+}
+
+// 读取一页，不在缓存中时从文件读取并检查校验和
+func (b *bufferPool) get(id uint32) ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if e, ok := b.frames[id]; ok {
+		b.hits++
+		b.lru.MoveToFront(e)
+		return e.Value.(*frame).data, nil
+	}
+	b.misses++
+	data := make([]byte, PageSize)
+	if _, err := b.f.ReadAt(data, int64(id)*PageSize); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if err := checkPage(id, data); err != nil {
+		return nil, err
+	}
+	b.frames[id] = b.lru.PushFront(&frame{id: id, data: data})
+	return data, b.evict()
+}
+
+// 写入一页，只修改缓存并标记为脏页，data之后不能再修改
+func (b *bufferPool) put(id uint32, data []byte) error {
+	sealPage(data)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if e, ok := b.frames[id]; ok {
+		fr := e.Value.(*frame)
+		fr.data, fr.dirty = data, true
+		b.lru.MoveToFront(e)
+		return nil
+	}
+	b.frames[id] = b.lru.PushFront(&frame{id: id, data: data, dirty: true})
+	return b.evict()
+}
+
+// 超过容量时淘汰最久没有使用的页，脏页先写回文件
+func (b *bufferPool) evict() error {
+	for b.lru.Len() > b.capacity {
+		e := b.lru.Back()
+		fr := e.Value.(*frame)
+		if fr.dirty {
+			if err := b.write(fr); err != nil {
+				return err
+			}
+		}
+		b.lru.Remove(e)
+		delete(b.frames, fr.id)
+		b.evictions++
+	}
+	return nil
+}
+
+func (b *bufferPool) write(fr *frame) error {
+	if _, err := b.f.WriteAt(fr.data, int64(fr.id)*PageSize); err != nil {
+		return err
+	}
+	fr.dirty = false
+	b.writes++
+	return nil
+}
+
+// 按页号顺序写回所有脏页并fsync
+func (b *bufferPool) flush() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var dirty []*frame
+	for _, e := range b.frames {
+		if fr := e.Value.(*frame); fr.dirty {
+			dirty = append(dirty, fr)
+		}
+	}
+	sort.Slice(dirty, func(i, j int) bool {
+		return dirty[i].id < dirty[j].id
+	})
+	for _, fr := range dirty {
+		if err := b.write(fr); err != nil {
+			return err
+		}
+	}
+	return b.f.Sync()
+}
+
+type poolStats struct {
+	pages, dirty                    int
+	hits, misses, evictions, writes uint64
+}
+
+func (b *bufferPool) stats() poolStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := poolStats{pages: b.lru.Len(), hits: b.hits, misses: b.misses, evictions: b.evictions, writes: b.writes}
+	for _, e := range b.frames {
+		if e.Value.(*frame).dirty {
+			s.dirty++
+		}
+	}
+	return s
+}
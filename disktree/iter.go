@@ -0,0 +1,144 @@
+package disktree
+
+import "sort"
+
+// 顺序遍历所有数据，fn返回false时停止
+func (t *Tree) Ascend(fn func(key string, data []byte) bool) error {
+	return t.AscendGreaterOrEqual("", fn)
+}
+
+// 从第一个不小于pivot的key开始顺序遍历
+// 每次在读锁内复制一个叶子节点的数据，fn在不持有锁时调用，可以在fn中修改树，下一批从上一批最后一个key之后重新查找
+func (t *Tree) AscendGreaterOrEqual(pivot string, fn func(key string, data []byte) bool) error {
+	key, strict := pivot, false
+	for {
+		keys, values, err := t.batchAfter(key, strict)
+		if err != nil || len(keys) == 0 {
+			return err
+		}
+		for i := range keys {
+			if !fn(keys[i], values[i]) {
+				return nil
+			}
+		}
+		key, strict = keys[len(keys)-1], true
+	}
+}
+
+// 倒序遍历所有数据
+func (t *Tree) Descend(fn func(key string, data []byte) bool) error {
+	return t.descendFrom("", false, true, fn)
+}
+
+// 从最后一个不大于pivot的key开始倒序遍历
+func (t *Tree) DescendLessOrEqual(pivot string, fn func(key string, data []byte) bool) error {
+	return t.descendFrom(pivot, false, false, fn)
+}
+
+func (t *Tree) descendFrom(key string, strict bool, last bool, fn func(key string, data []byte) bool) error {
+	for {
+		keys, values, err := t.batchBefore(key, strict, last)
+		if err != nil || len(keys) == 0 {
+			return err
+		}
+		for i := len(keys) - 1; i >= 0; i-- {
+			if !fn(keys[i], values[i]) {
+				return nil
+			}
+		}
+		key, strict, last = keys[0], true, false
+	}
+}
+
+// 复制第一个不小于key(strict时大于key)的数据所在叶子节点中从它开始的数据，没有时返回空
+func (t *Tree) batchAfter(key string, strict bool) ([]string, [][]byte, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.closed {
+		return nil, nil, ErrClosed
+	}
+	leaf, _, err := t.descend(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	i := sort.Search(len(leaf.keys), func(i int) bool {
+		if strict {
+			return leaf.keys[i] > key
+		}
+		return leaf.keys[i] >= key
+	})
+	// 当前叶子节点中没有时沿着next找下一个不为空的叶子节点
+	for i == len(leaf.keys) {
+		if leaf.next == 0 {
+			return nil, nil, nil
+		}
+		if leaf, err = t.readNode(leaf.next); err != nil {
+			return nil, nil, err
+		}
+		i = 0
+	}
+	return t.copyLeaf(leaf, i, len(leaf.keys))
+}
+
+// 复制最后一个不大于key(strict时小于key)的数据所在叶子节点中到它为止的数据，last为true时从最大的key开始
+// 叶子节点没有prev指针，当前叶子节点中没有时用路径上的下界重新从根节点查找前一个叶子节点
+func (t *Tree) batchBefore(key string, strict bool, last bool) ([]string, [][]byte, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.closed {
+		return nil, nil, ErrClosed
+	}
+	for {
+		n, err := t.readNode(t.root)
+		// 路径上最近一个在左边分隔当前子树的key，当前子树中的key都不小于它
+		lower, hasLower := "", false
+		for err == nil && !n.leaf {
+			i := len(n.children) - 1
+			if !last {
+				i = sort.Search(len(n.keys), func(i int) bool {
+					if strict {
+						return n.keys[i] >= key
+					}
+					return n.keys[i] > key
+				})
+			}
+			if i > 0 {
+				lower, hasLower = n.keys[i-1], true
+			}
+			n, err = t.readNode(n.children[i])
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		end := len(n.keys)
+		if !last {
+			end = sort.Search(len(n.keys), func(i int) bool {
+				if strict {
+					return n.keys[i] >= key
+				}
+				return n.keys[i] > key
+			})
+		}
+		if end > 0 {
+			return t.copyLeaf(n, 0, end)
+		}
+		if !hasLower {
+			return nil, nil, nil
+		}
+		key, strict, last = lower, true, false
+	}
+}
+
+// 复制叶子节点中[from, to)的数据，溢出页中的值也一起读出来
+func (t *Tree) copyLeaf(leaf *node, from int, to int) ([]string, [][]byte, error) {
+	keys := leaf.keys[from:to]
+	values := make([][]byte, len(keys))
+	for i := range keys {
+		data, err := t.loadValue(leaf.values[from+i])
+		if err != nil {
+			return nil, nil, err
+		}
+		values[i] = data
+	}
+	return keys, values, nil
+}
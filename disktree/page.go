@@ -0,0 +1,227 @@
+// 页的格式，所有页大小相同，前4字节是后面内容的crc32校验和，第5个字节是页的类型，多字节整数都是小端序
+// 叶子节点：数量(2) next(4) 然后每条数据是 key长度(2) key 值的类型(1) 值
+//   值直接存在页里时是 长度(2) 数据，放不下时存到溢出页链表里，这里是 第一个溢出页(4) 总长度(4)
+// 内部节点：数量(2) 第一个子节点(4) 然后每条是 key长度(2) key 子节点(4)，children[i]中的key都小于keys[i]，children[i+1]中的key都不小于keys[i]
+// 溢出页：下一页(4) 长度(2) 数据
+// 空闲页：下一个空闲页(4)
+
+package disktree
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+const (
+	// 页大小
+	PageSize = 4096
+	// key的最大长度，保证一个页至少能放下两条数据，分裂后两边都能放进一页
+	MaxKeySize = 400
+	// 值超过这个长度时存到溢出页
+	maxInlineValue = 800
+
+	nodeHeaderSize     = 11
+	overflowHeaderSize = 11
+	overflowCapacity   = PageSize - overflowHeaderSize
+	// 节点小于这个大小时和兄弟节点合并或者重新分配
+	minFillSize = PageSize / 4
+)
+
+const (
+	pageMeta byte = iota
+	pageLeaf
+	pageInternal
+	pageOverflow
+	pageFree
+)
+
+var (
+	// 页的校验和不对或者格式不对，一般是写到一半崩溃或者文件被破坏
+	ErrCorrupt = errors.New("disktree: corrupt page")
+	// key超过MaxKeySize
+	ErrKeyTooLarge = errors.New("disktree: key too large")
+	ErrClosed      = errors.New("disktree: tree is closed")
+)
+
+// 叶子节点中的值，overflow不为0时数据在溢出页中
+type value struct {
+	data     []byte
+	overflow uint32
+	length   uint32
+}
+
+func (v value) size() int {
+	if v.overflow != 0 {
+		return 1 + 8
+	}
+	return 1 + 2 + len(v.data)
+}
+
+// 解码后的节点，修改之后重新编码写回原来的页
+type node struct {
+	id       uint32
+	leaf     bool
+	keys     []string
+	values   []value  // 叶子节点
+	children []uint32 // 内部节点，比keys多一个
+	next     uint32   // 叶子节点，右边的兄弟，0表示没有
+}
+
+func leafEntrySize(key string, v value) int {
+	return 2 + len(key) + v.size()
+}
+
+func internalEntrySize(key string) int {
+	return 2 + len(key) + 4
+}
+
+// 编码后的大小
+func (n *node) size() int {
+	size := nodeHeaderSize
+	for i, k := range n.keys {
+		if n.leaf {
+			size += leafEntrySize(k, n.values[i])
+		} else {
+			size += internalEntrySize(k)
+		}
+	}
+	return size
+}
+
+// 编码到一个新的页
+func (n *node) encode() []byte {
+	buf := make([]byte, PageSize)
+	le := binary.LittleEndian
+	le.PutUint16(buf[5:7], uint16(len(n.keys)))
+	if n.leaf {
+		buf[4] = pageLeaf
+		le.PutUint32(buf[7:11], n.next)
+	} else {
+		buf[4] = pageInternal
+		le.PutUint32(buf[7:11], n.children[0])
+	}
+	off := nodeHeaderSize
+	for i, k := range n.keys {
+		le.PutUint16(buf[off:], uint16(len(k)))
+		off += 2
+		off += copy(buf[off:], k)
+		if !n.leaf {
+			le.PutUint32(buf[off:], n.children[i+1])
+			off += 4
+			continue
+		}
+		v := n.values[i]
+		if v.overflow != 0 {
+			buf[off] = 1
+			le.PutUint32(buf[off+1:], v.overflow)
+			le.PutUint32(buf[off+5:], v.length)
+			off += 9
+			continue
+		}
+		buf[off] = 0
+		le.PutUint16(buf[off+1:], uint16(len(v.data)))
+		off += 3
+		off += copy(buf[off:], v.data)
+	}
+	return buf
+}
+
+// 解码节点，页的类型不是节点或者内容越界时返回ErrCorrupt
+func decodeNode(id uint32, buf []byte) (*node, error) {
+	le := binary.LittleEndian
+	n := &node{id: id}
+	switch buf[4] {
+	case pageLeaf:
+		n.leaf = true
+		n.next = le.Uint32(buf[7:11])
+	case pageInternal:
+		n.children = append(n.children, le.Uint32(buf[7:11]))
+	default:
+		return nil, fmt.Errorf("%w: page %d is not a node (type %d)", ErrCorrupt, id, buf[4])
+	}
+	count := int(le.Uint16(buf[5:7]))
+	off := nodeHeaderSize
+	// 读取length个字节，越界时返回nil
+	take := func(length int) []byte {
+		if off+length > len(buf) {
+			return nil
+		}
+		b := buf[off : off+length]
+		off += length
+		return b
+	}
+	bad := fmt.Errorf("%w: page %d is truncated", ErrCorrupt, id)
+	for i := 0; i < count; i++ {
+		b := take(2)
+		if b == nil {
+			return nil, bad
+		}
+		k := take(int(le.Uint16(b)))
+		if k == nil {
+			return nil, bad
+		}
+		n.keys = append(n.keys, string(k))
+		if !n.leaf {
+			if b = take(4); b == nil {
+				return nil, bad
+			}
+			n.children = append(n.children, le.Uint32(b))
+			continue
+		}
+		kind := take(1)
+		if kind == nil {
+			return nil, bad
+		}
+		if kind[0] == 1 {
+			if b = take(8); b == nil {
+				return nil, bad
+			}
+			n.values = append(n.values, value{overflow: le.Uint32(b[0:4]), length: le.Uint32(b[4:8])})
+			continue
+		}
+		if b = take(2); b == nil {
+			return nil, bad
+		}
+		data := take(int(le.Uint16(b)))
+		if data == nil {
+			return nil, bad
+		}
+		n.values = append(n.values, value{data: append([]byte(nil), data...)})
+	}
+	return n, nil
+}
+
+// 写入前计算校验和
+func sealPage(buf []byte) {
+	binary.LittleEndian.PutUint32(buf[0:4], crc32.ChecksumIEEE(buf[4:]))
+}
+
+// 读取后检查校验和
+func checkPage(id uint32, buf []byte) error {
+	if binary.LittleEndian.Uint32(buf[0:4]) != crc32.ChecksumIEEE(buf[4:]) {
+		return fmt.Errorf("%w: checksum mismatch on page %d", ErrCorrupt, id)
+	}
+	return nil
+}
+
+// 选择分裂的位置，sizes是每条数据的大小，返回右边第一条的下标，两边的总大小尽量接近并且都不为空
+func splitPoint(sizes []int) int {
+	total := 0
+	for _, s := range sizes {
+		total += s
+	}
+	left := 0
+	for i, s := range sizes {
+		if left+s > total/2 {
+			// 第i条放在左边还是右边，选两边差距小的
+			if i > 0 && total/2-left < left+s-total/2 {
+				return i
+			}
+			return min(i+1, len(sizes)-1)
+		}
+		left += s
+	}
+	return len(sizes) - 1
+}
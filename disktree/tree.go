@@ -0,0 +1,591 @@
+// 存在磁盘文件中的B+树，key是字符串，值是任意字节
+// 所有页大小相同，第0页是元数据，删除节点和溢出页后空出来的页挂在空闲链表上，分配新页时优先复用
+// 页通过bufferPool读写，修改过的页在淘汰或者Flush时写回文件，Close时写回所有页并标记文件正常关闭
+// 写操作互斥，读操作之间可以并发，遍历时每次只在读锁内复制一个叶子节点的数据
+
+package disktree
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+)
+
+var metaMagic = []byte("WR2DISK1")
+
+// 默认缓存的页数
+const DefaultCachePages = 1024
+
+type Tree struct {
+	mu        sync.RWMutex
+	f         *os.File
+	pool      *bufferPool
+	root      uint32
+	pageCount uint32 // 文件中的页数，新页的页号
+	freeHead  uint32 // 空闲链表的第一页，0表示没有
+	freeCount uint32
+	count     int
+	seq       uint64 // 调用方保存在元数据中的序列号
+	clean     bool   // 打开之前文件是否正常关闭
+	closed    bool
+}
+
+// 打开或者创建树文件，cachePages是缓存的页数
+// 上次没有正常关闭时先检查整棵树，检查不通过返回ErrCorrupt
+func Open(path string, cachePages int) (*Tree, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	t := &Tree{f: f, pool: newBufferPool(f, max(cachePages, 16))}
+	if err := t.open(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("disktree %s: %w", path, err)
+	}
+	return t, nil
+}
+
+func (t *Tree) open() error {
+	info, err := t.f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		// 新文件，根节点是一个空的叶子节点
+		t.root, t.pageCount = 1, 2
+		if err := t.writeNode(&node{id: 1, leaf: true}); err != nil {
+			return err
+		}
+		if err := t.pool.flush(); err != nil {
+			return err
+		}
+		return t.writeMeta(false)
+	}
+	clean, err := t.readMeta()
+	if err != nil {
+		return err
+	}
+	t.clean = clean
+	if !clean {
+		if err := t.Validate(); err != nil {
+			return fmt.Errorf("not closed cleanly: %w", err)
+		}
+	}
+	// 打开期间标记为没有正常关闭，崩溃之后下次打开时会检查
+	return t.writeMeta(false)
+}
+
+// 元数据页：魔数(8) 页大小(4) 根节点(4) 页数(4) 空闲链表(4) 空闲页数(4) 数据数量(8) 是否正常关闭(1) 序列号(8)
+func (t *Tree) writeMeta(clean bool) error {
+	buf := make([]byte, PageSize)
+	le := binary.LittleEndian
+	copy(buf[4:12], metaMagic)
+	le.PutUint32(buf[12:16], PageSize)
+	le.PutUint32(buf[16:20], t.root)
+	le.PutUint32(buf[20:24], t.pageCount)
+	le.PutUint32(buf[24:28], t.freeHead)
+	le.PutUint32(buf[28:32], t.freeCount)
+	le.PutUint64(buf[32:40], uint64(t.count))
+	if clean {
+		buf[40] = 1
+	}
+	le.PutUint64(buf[41:49], t.seq)
+	sealPage(buf)
+	if _, err := t.f.WriteAt(buf, 0); err != nil {
+		return err
+	}
+	return t.f.Sync()
+}
+
+func (t *Tree) readMeta() (bool, error) {
+	buf := make([]byte, PageSize)
+	if _, err := t.f.ReadAt(buf, 0); err != nil {
+		return false, err
+	}
+	if err := checkPage(0, buf); err != nil {
+		return false, err
+	}
+	le := binary.LittleEndian
+	if string(buf[4:12]) != string(metaMagic) {
+		return false, fmt.Errorf("%w: not a disktree file", ErrCorrupt)
+	}
+	if size := le.Uint32(buf[12:16]); size != PageSize {
+		return false, fmt.Errorf("%w: page size %d, want %d", ErrCorrupt, size, PageSize)
+	}
+	t.root = le.Uint32(buf[16:20])
+	t.pageCount = le.Uint32(buf[20:24])
+	t.freeHead = le.Uint32(buf[24:28])
+	t.freeCount = le.Uint32(buf[28:32])
+	t.count = int(le.Uint64(buf[32:40]))
+	t.seq = le.Uint64(buf[41:49])
+	return buf[40] == 1, nil
+}
+
+func (t *Tree) readNode(id uint32) (*node, error) {
+	buf, err := t.pool.get(id)
+	if err != nil {
+		return nil, err
+	}
+	return decodeNode(id, buf)
+}
+
+func (t *Tree) writeNode(n *node) error {
+	if n.size() > PageSize {
+		panic(fmt.Sprintf("disktree: node %d does not fit in a page", n.id))
+	}
+	return t.pool.put(n.id, n.encode())
+}
+
+// 分配一页，优先使用空闲链表
+func (t *Tree) allocate() (uint32, error) {
+	if t.freeHead == 0 {
+		id := t.pageCount
+		t.pageCount++
+		return id, nil
+	}
+	id := t.freeHead
+	buf, err := t.pool.get(id)
+	if err != nil {
+		return 0, err
+	}
+	if buf[4] != pageFree {
+		return 0, fmt.Errorf("%w: page %d on the free list has type %d", ErrCorrupt, id, buf[4])
+	}
+	t.freeHead = binary.LittleEndian.Uint32(buf[5:9])
+	t.freeCount--
+	return id, nil
+}
+
+// 释放一页，挂到空闲链表的头部
+func (t *Tree) free(id uint32) error {
+	buf := make([]byte, PageSize)
+	buf[4] = pageFree
+	binary.LittleEndian.PutUint32(buf[5:9], t.freeHead)
+	if err := t.pool.put(id, buf); err != nil {
+		return err
+	}
+	t.freeHead = id
+	t.freeCount++
+	return nil
+}
+
+// 保存值，太长的值写到溢出页链表
+func (t *Tree) storeValue(data []byte) (value, error) {
+	if len(data) <= maxInlineValue {
+		return value{data: append([]byte(nil), data...)}, nil
+	}
+	ids := make([]uint32, (len(data)+overflowCapacity-1)/overflowCapacity)
+	for i := range ids {
+		id, err := t.allocate()
+		if err != nil {
+			return value{}, err
+		}
+		ids[i] = id
+	}
+	le := binary.LittleEndian
+	for i, id := range ids {
+		buf := make([]byte, PageSize)
+		buf[4] = pageOverflow
+		if i+1 < len(ids) {
+			le.PutUint32(buf[5:9], ids[i+1])
+		}
+		chunk := data[i*overflowCapacity : min((i+1)*overflowCapacity, len(data))]
+		le.PutUint16(buf[9:11], uint16(len(chunk)))
+		copy(buf[overflowHeaderSize:], chunk)
+		if err := t.pool.put(id, buf); err != nil {
+			return value{}, err
+		}
+	}
+	return value{overflow: ids[0], length: uint32(len(data))}, nil
+}
+
+// 沿着溢出页链表处理每一页，fn的参数是页号和页中的数据
+func (t *Tree) walkOverflow(v value, fn func(id uint32, chunk []byte) error) error {
+	le := binary.LittleEndian
+	remaining := int(v.length)
+	for id := v.overflow; id != 0; {
+		buf, err := t.pool.get(id)
+		if err != nil {
+			return err
+		}
+		length := int(le.Uint16(buf[9:11]))
+		if buf[4] != pageOverflow || length > overflowCapacity || length > remaining {
+			return fmt.Errorf("%w: bad overflow page %d", ErrCorrupt, id)
+		}
+		if err := fn(id, buf[overflowHeaderSize:overflowHeaderSize+length]); err != nil {
+			return err
+		}
+		remaining -= length
+		id = le.Uint32(buf[5:9])
+	}
+	if remaining != 0 {
+		return fmt.Errorf("%w: overflow chain from page %d is %d bytes short", ErrCorrupt, v.overflow, remaining)
+	}
+	return nil
+}
+
+func (t *Tree) loadValue(v value) ([]byte, error) {
+	if v.overflow == 0 {
+		return v.data, nil
+	}
+	data := make([]byte, 0, v.length)
+	err := t.walkOverflow(v, func(_ uint32, chunk []byte) error {
+		data = append(data, chunk...)
+		return nil
+	})
+	return data, err
+}
+
+func (t *Tree) freeValue(v value) error {
+	if v.overflow == 0 {
+		return nil
+	}
+	var ids []uint32
+	if err := t.walkOverflow(v, func(id uint32, _ []byte) error {
+		ids = append(ids, id)
+		return nil
+	}); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := t.free(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 内部节点中key所在的子节点下标，keys[i-1] <= key < keys[i]
+func childIndex(keys []string, key string) int {
+	return sort.Search(len(keys), func(i int) bool {
+		return keys[i] > key
+	})
+}
+
+// 从根节点到叶子节点的路径上的一步，index是进入的子节点下标
+type step struct {
+	n     *node
+	index int
+}
+
+// 找到key所在的叶子节点，返回叶子节点和路径
+func (t *Tree) descend(key string) (*node, []step, error) {
+	var path []step
+	n, err := t.readNode(t.root)
+	for err == nil && !n.leaf {
+		i := childIndex(n.keys, key)
+		path = append(path, step{n, i})
+		n, err = t.readNode(n.children[i])
+	}
+	return n, path, err
+}
+
+// 查找，返回值的拷贝
+func (t *Tree) Get(key string) ([]byte, bool, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.closed {
+		return nil, false, ErrClosed
+	}
+	leaf, _, err := t.descend(key)
+	if err != nil {
+		return nil, false, err
+	}
+	i := sort.SearchStrings(leaf.keys, key)
+	if i == len(leaf.keys) || leaf.keys[i] != key {
+		return nil, false, nil
+	}
+	data, err := t.loadValue(leaf.values[i])
+	return data, err == nil, err
+}
+
+// 插入或者替换，返回key原来是否存在
+func (t *Tree) Put(key string, data []byte) (bool, error) {
+	if len(key) > MaxKeySize {
+		return false, ErrKeyTooLarge
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return false, ErrClosed
+	}
+	leaf, path, err := t.descend(key)
+	if err != nil {
+		return false, err
+	}
+	v, err := t.storeValue(data)
+	if err != nil {
+		return false, err
+	}
+	i := sort.SearchStrings(leaf.keys, key)
+	if i < len(leaf.keys) && leaf.keys[i] == key {
+		old := leaf.values[i]
+		leaf.values[i] = v
+		if err := t.freeValue(old); err != nil {
+			return true, err
+		}
+		return true, t.splitUp(leaf, path)
+	}
+	leaf.keys = insertAt(leaf.keys, i, key)
+	leaf.values = insertAt(leaf.values, i, v)
+	t.count++
+	return false, t.splitUp(leaf, path)
+}
+
+// 写回修改过的节点，超过一页时分裂，分裂出的节点插入父节点，一直处理到根节点
+func (t *Tree) splitUp(n *node, path []step) error {
+	for n.size() > PageSize {
+		id, err := t.allocate()
+		if err != nil {
+			return err
+		}
+		right, sep := split(n, id)
+		if err := t.writeNode(n); err != nil {
+			return err
+		}
+		if err := t.writeNode(right); err != nil {
+			return err
+		}
+		if len(path) == 0 {
+			id, err := t.allocate()
+			if err != nil {
+				return err
+			}
+			t.root = id
+			return t.writeNode(&node{id: id, keys: []string{sep}, children: []uint32{n.id, right.id}})
+		}
+		parent := path[len(path)-1]
+		path = path[:len(path)-1]
+		parent.n.keys = insertAt(parent.n.keys, parent.index, sep)
+		parent.n.children = insertAt(parent.n.children, parent.index+1, right.id)
+		n = parent.n
+	}
+	return t.writeNode(n)
+}
+
+// 把n按大小分成两半，右边的节点使用页id，返回右边的节点和父节点中分隔两边的key
+func split(n *node, id uint32) (*node, string) {
+	right := &node{id: id, leaf: n.leaf}
+	sizes := make([]int, len(n.keys))
+	for i, k := range n.keys {
+		if n.leaf {
+			sizes[i] = leafEntrySize(k, n.values[i])
+		} else {
+			sizes[i] = internalEntrySize(k)
+		}
+	}
+	mid := splitPoint(sizes)
+	if n.leaf {
+		right.keys = append([]string(nil), n.keys[mid:]...)
+		right.values = append([]value(nil), n.values[mid:]...)
+		right.next, n.next = n.next, id
+		n.keys, n.values = n.keys[:mid], n.values[:mid]
+		return right, right.keys[0]
+	}
+	// 内部节点中间的key移到父节点
+	sep := n.keys[mid]
+	right.keys = append([]string(nil), n.keys[mid+1:]...)
+	right.children = append([]uint32(nil), n.children[mid+1:]...)
+	n.keys, n.children = n.keys[:mid], n.children[:mid+1]
+	return right, sep
+}
+
+// 删除，返回key是否存在
+func (t *Tree) Delete(key string) (bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return false, ErrClosed
+	}
+	leaf, path, err := t.descend(key)
+	if err != nil {
+		return false, err
+	}
+	i := sort.SearchStrings(leaf.keys, key)
+	if i == len(leaf.keys) || leaf.keys[i] != key {
+		return false, nil
+	}
+	old := leaf.values[i]
+	leaf.keys = removeAt(leaf.keys, i)
+	leaf.values = removeAt(leaf.values, i)
+	t.count--
+	if err := t.freeValue(old); err != nil {
+		return true, err
+	}
+	return true, t.mergeUp(leaf, path)
+}
+
+// 写回修改过的节点，小于minFillSize时和兄弟节点合并或者重新分配，父节点因此变小时继续向上处理
+// 根节点是只有一个子节点的内部节点时，子节点成为新的根节点
+func (t *Tree) mergeUp(n *node, path []step) error {
+	for len(path) > 0 && n.size() < minFillSize {
+		p := path[len(path)-1]
+		path = path[:len(path)-1]
+		parent := p.n
+		li := p.index - 1
+		if p.index == 0 {
+			li = 0
+		}
+		left, right := n, n
+		var err error
+		if p.index == 0 {
+			right, err = t.readNode(parent.children[1])
+		} else {
+			left, err = t.readNode(parent.children[li])
+		}
+		if err != nil {
+			return err
+		}
+		if err := t.rebalance(parent, li, left, right); err != nil {
+			return err
+		}
+		n = parent
+	}
+	if len(path) == 0 && !n.leaf && len(n.keys) == 0 {
+		t.root = n.children[0]
+		return t.free(n.id)
+	}
+	return t.writeNode(n)
+}
+
+// 合并或者重新分配parent的第li和li+1个子节点，两个节点的数据放得进一页时合并到左边，否则按大小平分
+// 写回两个子节点，parent只在内存中修改，由调用方写回
+func (t *Tree) rebalance(parent *node, li int, left *node, right *node) error {
+	merged := &node{id: left.id, leaf: left.leaf}
+	if left.leaf {
+		merged.keys = append(append([]string(nil), left.keys...), right.keys...)
+		merged.values = append(append([]value(nil), left.values...), right.values...)
+		merged.next = right.next
+	} else {
+		merged.keys = append(append(append([]string(nil), left.keys...), parent.keys[li]), right.keys...)
+		merged.children = append(append([]uint32(nil), left.children...), right.children...)
+	}
+	if merged.size() <= PageSize {
+		parent.keys = removeAt(parent.keys, li)
+		parent.children = removeAt(parent.children, li+1)
+		if err := t.writeNode(merged); err != nil {
+			return err
+		}
+		return t.free(right.id)
+	}
+	// 放不进一页，用分裂的方法重新分成两半，右边沿用原来的页
+	newRight, sep := split(merged, right.id)
+	parent.keys[li] = sep
+	if err := t.writeNode(merged); err != nil {
+		return err
+	}
+	return t.writeNode(newRight)
+}
+
+func insertAt[T any](s []T, i int, v T) []T {
+	var zero T
+	s = append(s, zero)
+	copy(s[i+1:], s[i:])
+	s[i] = v
+	return s
+}
+
+func removeAt[T any](s []T, i int) []T {
+	copy(s[i:], s[i+1:])
+	var zero T
+	s[len(s)-1] = zero
+	return s[:len(s)-1]
+}
+
+func (t *Tree) Len() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.count
+}
+
+// 打开之前文件是否正常关闭，新建的文件返回false
+func (t *Tree) ClosedCleanly() bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.clean
+}
+
+// 元数据中保存的序列号，由调用方通过SetSeq设置，树本身不使用
+func (t *Tree) Seq() uint64 {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.seq
+}
+
+// 设置序列号，下一次Flush或者Close时和元数据一起写入
+func (t *Tree) SetSeq(seq uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.seq = seq
+}
+
+// 把所有修改过的页写回文件并fsync，同时写入元数据，文件仍然标记为没有正常关闭
+func (t *Tree) Flush() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return ErrClosed
+	}
+	if err := t.pool.flush(); err != nil {
+		return err
+	}
+	return t.writeMeta(false)
+}
+
+// 写回所有页，标记正常关闭后关闭文件
+func (t *Tree) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return nil
+	}
+	t.closed = true
+	err := t.pool.flush()
+	if err == nil {
+		err = t.writeMeta(true)
+	}
+	if cerr := t.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// 树的统计信息，Pages包括元数据页和空闲页
+type Stats struct {
+	Height      int
+	Keys        int
+	Pages       int
+	FreePages   int
+	CachePages  int
+	DirtyPages  int
+	CacheHits   uint64
+	CacheMisses uint64
+	Evictions   uint64
+	PageWrites  uint64
+}
+
+func (t *Tree) Stats() (Stats, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.closed {
+		return Stats{}, ErrClosed
+	}
+	s := Stats{Keys: t.count, Pages: int(t.pageCount), FreePages: int(t.freeCount)}
+	for id := t.root; ; {
+		n, err := t.readNode(id)
+		if err != nil {
+			return s, err
+		}
+		s.Height++
+		if n.leaf {
+			break
+		}
+		id = n.children[0]
+	}
+	ps := t.pool.stats()
+	s.CachePages, s.DirtyPages = ps.pages, ps.dirty
+	s.CacheHits, s.CacheMisses, s.Evictions, s.PageWrites = ps.hits, ps.misses, ps.evictions, ps.writes
+	return s, nil
+}
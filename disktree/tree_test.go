@@ -0,0 +1,249 @@
+package disktree_test
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"wr_2/disktree"
+)
+
+// 3000个key，其中一部分很长，让节点按字节数分裂
+func randKey(r *rand.Rand) string {
+	n := r.Intn(3000)
+	k := fmt.Sprintf("k%05d", n)
+	if n%7 == 0 {
+		k += strings.Repeat("x", r.Intn(390))
+	}
+	return k
+}
+
+// 大部分是短值，十分之一超过800字节存到溢出页
+func randValue(r *rand.Rand) []byte {
+	var n int
+	switch r.Intn(10) {
+	case 0:
+		n = 800 + r.Intn(20000)
+	case 1:
+		n = 0
+	default:
+		n = r.Intn(200)
+	}
+	b := make([]byte, n)
+	r.Read(b)
+	return b
+}
+
+// 检查结构、数量、正序和倒序遍历，再随机检查几个起点的范围遍历
+func checkTree(t *testing.T, tr *disktree.Tree, ref map[string][]byte, r *rand.Rand) {
+	t.Helper()
+	if err := tr.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if tr.Len() != len(ref) {
+		t.Fatalf("Len %d, want %d", tr.Len(), len(ref))
+	}
+	keys := make([]string, 0, len(ref))
+	for k := range ref {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var got []string
+	err := tr.Ascend(func(k string, v []byte) bool {
+		if !bytes.Equal(v, ref[k]) {
+			t.Fatalf("Ascend: wrong value for %q", k)
+		}
+		got = append(got, k)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(got, ",") != strings.Join(keys, ",") {
+		t.Fatalf("Ascend returned %d keys, want %d", len(got), len(keys))
+	}
+	got = got[:0]
+	tr.Descend(func(k string, v []byte) bool {
+		got = append(got, k)
+		return true
+	})
+	if len(got) != len(keys) {
+		t.Fatalf("Descend returned %d keys, want %d", len(got), len(keys))
+	}
+	for i := range got {
+		if got[i] != keys[len(keys)-1-i] {
+			t.Fatalf("Descend: %q at %d, want %q", got[i], i, keys[len(keys)-1-i])
+		}
+	}
+	for j := 0; j < 20; j++ {
+		p := randKey(r)
+		i := sort.SearchStrings(keys, p)
+		var first string
+		tr.AscendGreaterOrEqual(p, func(k string, v []byte) bool {
+			first = k
+			return false
+		})
+		want := ""
+		if i < len(keys) {
+			want = keys[i]
+		}
+		if first != want {
+			t.Fatalf("AscendGreaterOrEqual(%q) started at %q, want %q", p, first, want)
+		}
+		n := sort.Search(len(keys), func(i int) bool { return keys[i] > p })
+		var count int
+		var last string
+		tr.DescendLessOrEqual(p, func(k string, v []byte) bool {
+			if count == 0 {
+				last = k
+			}
+			count++
+			return true
+		})
+		if count != n || n > 0 && last != keys[n-1] {
+			t.Fatalf("DescendLessOrEqual(%q) returned %d keys starting at %q, want %d", p, count, last, n)
+		}
+	}
+}
+
+// 随机写入删除，先增长再缩小，中途关闭再打开，最后删除所有数据，每一步都和参考map比较
+func TestRandomAgainstMap(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "t.db")
+	seeds, ops := int64(3), 30000
+	if testing.Short() {
+		seeds, ops = 1, 12000
+	}
+	for seed := int64(1); seed <= seeds; seed++ {
+		os.Remove(path)
+		r := rand.New(rand.NewSource(seed))
+		tr, err := disktree.Open(path, 16)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ref := map[string][]byte{}
+		for i := 0; i < ops; i++ {
+			k := randKey(r)
+			del := r.Intn(10) < 3
+			if i > ops*2/3 {
+				del = r.Intn(10) < 8
+			}
+			if del {
+				found, err := tr.Delete(k)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, want := ref[k]; found != want {
+					t.Fatalf("Delete(%q) found %v, want %v", k, found, want)
+				}
+				delete(ref, k)
+			} else {
+				v := randValue(r)
+				if _, err := tr.Put(k, v); err != nil {
+					t.Fatal(err)
+				}
+				ref[k] = v
+			}
+			if i%3000 == 0 {
+				checkTree(t, tr, ref, r)
+			}
+			if i%10000 == 5000 {
+				if err := tr.Close(); err != nil {
+					t.Fatal(err)
+				}
+				if tr, err = disktree.Open(path, 16); err != nil {
+					t.Fatal(err)
+				}
+				checkTree(t, tr, ref, r)
+			}
+		}
+		checkTree(t, tr, ref, r)
+		for k := range ref {
+			if _, err := tr.Delete(k); err != nil {
+				t.Fatal(err)
+			}
+			delete(ref, k)
+		}
+		checkTree(t, tr, ref, r)
+		// 删除所有数据之后空出来的页都在空闲链表上，重新写入时复用
+		if s, _ := tr.Stats(); s.Pages != s.FreePages+2 {
+			t.Fatalf("after deleting everything: %d pages, %d free", s.Pages, s.FreePages)
+		}
+		if err := tr.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// 遍历时删除正在遍历的key
+func TestDeleteDuringAscend(t *testing.T) {
+	tr, err := disktree.Open(filepath.Join(t.TempDir(), "t.db"), 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+	for i := 0; i < 3000; i++ {
+		tr.Put(fmt.Sprintf("k%05d", i), []byte("v"))
+	}
+	n := 0
+	tr.Ascend(func(k string, v []byte) bool {
+		if _, err := tr.Delete(k); err != nil {
+			t.Fatal(err)
+		}
+		n++
+		return true
+	})
+	if n != 3000 || tr.Len() != 0 {
+		t.Fatalf("visited %d keys, %d left", n, tr.Len())
+	}
+	if err := tr.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 正常关闭时保存序列号，下次打开时ClosedCleanly为true；只Flush没有关闭时为false，数据仍然完整
+func TestReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "t.db")
+	tr, err := disktree.Open(path, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr.ClosedCleanly() {
+		t.Fatal("new file reports a clean close")
+	}
+	for i := 0; i < 500; i++ {
+		tr.Put(fmt.Sprintf("k%05d", i), bytes.Repeat([]byte{'v'}, i))
+	}
+	tr.SetSeq(42)
+	if err := tr.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tr, err = disktree.Open(path, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tr.ClosedCleanly() || tr.Seq() != 42 || tr.Len() != 500 {
+		t.Fatalf("after close: clean %v, seq %d, %d keys", tr.ClosedCleanly(), tr.Seq(), tr.Len())
+	}
+	tr.Delete("k00000")
+	if err := tr.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 没有关闭就重新打开，模拟进程崩溃
+	tr2, err := disktree.Open(path, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr2.Close()
+	if tr2.ClosedCleanly() || tr2.Len() != 499 {
+		t.Fatalf("after flush: clean %v, %d keys", tr2.ClosedCleanly(), tr2.Len())
+	}
+	if err := tr2.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
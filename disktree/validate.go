@@ -0,0 +1,146 @@
+package disktree
+
+import "fmt"
+
+// 检查整棵树：每一页的校验和、key的顺序和范围、节点大小、叶子节点深度相同、next链表、数据数量、溢出页和空闲链表
+// 所有页都必须属于树、溢出页或者空闲链表中的一个，而且只属于一个
+func (t *Tree) Validate() error {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	v := &validator{t: t, owner: make(map[uint32]string), leafDepth: -1}
+	if err := v.claim(0, "meta"); err != nil {
+		return err
+	}
+	if err := v.walk(t.root, 0, "", false, "", false); err != nil {
+		return err
+	}
+	// 叶子节点按顺序通过next连接，最后一个的next为0
+	for i, leaf := range v.leaves {
+		want := uint32(0)
+		if i+1 < len(v.leaves) {
+			want = v.leaves[i+1].id
+		}
+		if leaf.next != want {
+			return fmt.Errorf("%w: leaf %d next is %d, want %d", ErrCorrupt, leaf.id, leaf.next, want)
+		}
+	}
+	if v.keys != t.count {
+		return fmt.Errorf("%w: found %d keys, meta says %d", ErrCorrupt, v.keys, t.count)
+	}
+	free := uint32(0)
+	for id := t.freeHead; id != 0; free++ {
+		if err := v.claim(id, "free"); err != nil {
+			return err
+		}
+		buf, err := t.pool.get(id)
+		if err != nil {
+			return err
+		}
+		if buf[4] != pageFree {
+			return fmt.Errorf("%w: page %d on the free list has type %d", ErrCorrupt, id, buf[4])
+		}
+		id = uint32(buf[5]) | uint32(buf[6])<<8 | uint32(buf[7])<<16 | uint32(buf[8])<<24
+	}
+	if free != t.freeCount {
+		return fmt.Errorf("%w: free list has %d pages, meta says %d", ErrCorrupt, free, t.freeCount)
+	}
+	if len(v.owner) != int(t.pageCount) {
+		return fmt.Errorf("%w: %d of %d pages are in use or free, the rest are leaked", ErrCorrupt, len(v.owner), t.pageCount)
+	}
+	return nil
+}
+
+type validator struct {
+	t         *Tree
+	owner     map[uint32]string
+	leaves    []*node
+	leafDepth int
+	keys      int
+	prevKey   string
+	hasPrev   bool
+}
+
+// 记录页的用途，同一页被用了两次时报错
+func (v *validator) claim(id uint32, use string) error {
+	if id >= v.t.pageCount {
+		return fmt.Errorf("%w: %s page %d is beyond the end of the file (%d pages)", ErrCorrupt, use, id, v.t.pageCount)
+	}
+	if prev, ok := v.owner[id]; ok {
+		return fmt.Errorf("%w: page %d is used as %s and %s", ErrCorrupt, id, prev, use)
+	}
+	v.owner[id] = use
+	return nil
+}
+
+// 检查以id为根的子树，子树中的key都在[lo, hi)范围内
+func (v *validator) walk(id uint32, depth int, lo string, hasLo bool, hi string, hasHi bool) error {
+	if err := v.claim(id, "node"); err != nil {
+		return err
+	}
+	n, err := v.t.readNode(id)
+	if err != nil {
+		return err
+	}
+	if n.size() > PageSize {
+		return fmt.Errorf("%w: node %d is %d bytes", ErrCorrupt, id, n.size())
+	}
+	isRoot := id == v.t.root
+	if !isRoot && n.size() < minFillSize && len(n.keys) < 2 {
+		return fmt.Errorf("%w: node %d has only %d keys", ErrCorrupt, id, len(n.keys))
+	}
+	for i, k := range n.keys {
+		if i > 0 && n.keys[i-1] >= k {
+			return fmt.Errorf("%w: keys out of order in node %d: %q before %q", ErrCorrupt, id, n.keys[i-1], k)
+		}
+		if (hasLo && k < lo) || (hasHi && k >= hi) {
+			return fmt.Errorf("%w: key %q in node %d is outside its parent's range", ErrCorrupt, k, id)
+		}
+	}
+	if n.leaf {
+		if v.leafDepth == -1 {
+			v.leafDepth = depth
+		} else if depth != v.leafDepth {
+			return fmt.Errorf("%w: leaf %d at depth %d, other leaves at %d", ErrCorrupt, id, depth, v.leafDepth)
+		}
+		if !isRoot && len(n.keys) == 0 {
+			return fmt.Errorf("%w: leaf %d is empty", ErrCorrupt, id)
+		}
+		for i, k := range n.keys {
+			if v.hasPrev && k <= v.prevKey {
+				return fmt.Errorf("%w: leaf %d key %q is not after %q", ErrCorrupt, id, k, v.prevKey)
+			}
+			v.prevKey, v.hasPrev = k, true
+			val := n.values[i]
+			if val.overflow == 0 {
+				continue
+			}
+			if err := v.t.walkOverflow(val, func(page uint32, _ []byte) error {
+				return v.claim(page, "overflow")
+			}); err != nil {
+				return err
+			}
+		}
+		v.keys += len(n.keys)
+		v.leaves = append(v.leaves, n)
+		return nil
+	}
+	if len(n.children) != len(n.keys)+1 {
+		return fmt.Errorf("%w: internal node %d has %d keys and %d children", ErrCorrupt, id, len(n.keys), len(n.children))
+	}
+	if isRoot && len(n.keys) == 0 {
+		return fmt.Errorf("%w: root %d has a single child", ErrCorrupt, id)
+	}
+	for i, child := range n.children {
+		clo, chasLo, chi, chasHi := lo, hasLo, hi, hasHi
+		if i > 0 {
+			clo, chasLo = n.keys[i-1], true
+		}
+		if i < len(n.keys) {
+			chi, chasHi = n.keys[i], true
+		}
+		if err := v.walk(child, depth+1, clo, chasLo, chi, chasHi); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package disktree_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"wr_2/disktree"
+)
+
+// 没有正常关闭的文件打开时会检查整棵树，页被破坏时返回ErrCorrupt
+func TestOpenCorrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "t.db")
+	tr, err := disktree.Open(path, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2000; i++ {
+		tr.Put(fmt.Sprintf("k%05d", i), bytes.Repeat([]byte{'v'}, 100))
+	}
+	if err := tr.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte{1, 2, 3}, 3*disktree.PageSize+100)
+	f.Close()
+	if _, err := disktree.Open(path, 16); !errors.Is(err, disktree.ErrCorrupt) {
+		t.Fatalf("Open: %v, want ErrCorrupt", err)
+	}
+}
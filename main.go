@@ -1,20 +1,55 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"github.com/gin-gonic/gin"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 	"wr_2/router"
 )
 
 func main() {
 	// 指定端口
 	port := flag.String("p", "8080", "http port")
+	// 从快照恢复，代替从数据库加载
+	restore := flag.Bool("restore", false, "restore data from the snapshot instead of the database")
 	flag.Parse()
+	// 加载数据并重放日志，完成之后才开始处理请求
+	if err := router.LoadData(*port, *restore); err != nil {
+		panic(err)
+	}
 	// goroutine 处理gossip
 	go router.HandleGossip(*port)
 	go router.ExpirationMonitor()
+	go router.ExpirationSweeper()
+	go router.SnapshotScheduler()
+	go router.AOFRewriter()
 	r := gin.Default()
 	// 注册路由
 	r = router.InitRouter(r)
-	r.Run(":" + *port)
+	srv := &http.Server{Addr: ":" + *port, Handler: r}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			panic(err)
+		}
+	}()
+
+	// 收到退出信号后先停止接收请求，等处理中的请求结束，再写快照并关闭日志
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	<-ctx.Done()
+	stop()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		fmt.Println(err)
+	}
+	if err := router.Shutdown(); err != nil {
+		fmt.Println(err)
+	}
 }
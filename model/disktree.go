@@ -0,0 +1,454 @@
+package model
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"iter"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+	"wr_2/disktree"
+)
+
+// 使用磁盘上的B+树实现的数据结构，树本身在disktree包里实现，数据量超过内存时使用
+// 每条数据编码成JSON存在树里，和AOF、快照一样，数字读回来之后是float64
+// router拿到*DataPair之后会在记录锁内直接修改字段，所以Get和Put返回的数据在内存中保留一段时间(handle)，
+// 后台每秒把修改过的handle写回树，不会跳过正在被使用的handle，Close时全部写回
+// 每次访问都刷新handle的使用时间，空闲超过diskHandleIdle的handle写回后丢弃，之后再Get时重新从树中读出
+// 正常关闭时文件中保存了当时的AOF序列号，重启时直接使用文件中的数据，只重放之后的日志
+// 文件损坏或者上次没有正常关闭时数据和日志对不上，清空文件，和其他引擎一样从快照或数据库加载再重放日志
+type DiskTree struct {
+	closer
+	tree    *disktree.Tree
+	path    string
+	temp    bool // 没有配置diskDir时使用临时文件，关闭时删除
+	reused  bool // 文件中是上次正常关闭时的数据
+	mu      sync.Mutex
+	handles map[string]*diskHandle
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// 内存中的数据，written是上次写入树的编码，用来判断是否被修改过
+type diskHandle struct {
+	pair    *DataPair
+	written []byte
+	used    time.Time
+}
+
+// 存在树中的一条数据
+type diskRecord struct {
+	Value     interface{}
+	V         int64
+	Update    bool
+	CreatedAt int64
+	ExpiresAt int64 `json:",omitempty"`
+}
+
+const (
+	diskWriteBackInterval = time.Second
+	diskHandleIdle        = 10 * time.Second
+)
+
+func init() {
+	Register("DiskBPTree", func(config Config) (DataStruct, error) {
+		cachePages := disktree.DefaultCachePages
+		if s, ok := config("diskCachePages"); ok {
+			n, err := strconv.Atoi(s)
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("config diskCachePages must be a positive integer, got %q", s)
+			}
+			cachePages = n
+		}
+		dir, ok := config("diskDir")
+		if !ok {
+			f, err := os.CreateTemp("", "disktree-*.db")
+			if err != nil {
+				return nil, err
+			}
+			f.Close()
+			return OpenDiskTree(f.Name(), cachePages, true)
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+		port, _ := config("port")
+		return OpenDiskTree(filepath.Join(dir, "disktree-"+port+".db"), cachePages, false)
+	})
+}
+
+// 打开path，cachePages是页缓存的大小，temp为true时关闭后删除文件
+// 文件损坏或者上次没有正常关闭时清空后重新打开
+func OpenDiskTree(path string, cachePages int, temp bool) (*DiskTree, error) {
+	tree, err := disktree.Open(path, cachePages)
+	if err == nil && !tree.ClosedCleanly() && tree.Len() > 0 {
+		tree.Close()
+		err = errors.New("not closed cleanly")
+	}
+	if err != nil {
+		fmt.Printf("disktree %s: %v, starting with an empty file\n", path, err)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if tree, err = disktree.Open(path, cachePages); err != nil {
+			return nil, err
+		}
+	}
+	t := &DiskTree{tree: tree, path: path, temp: temp, reused: tree.ClosedCleanly() && !temp, handles: make(map[string]*diskHandle), done: make(chan struct{})}
+	t.wg.Add(1)
+	go t.writeBackLoop()
+	return t, nil
+}
+
+func (t *DiskTree) writeBackLoop() {
+	defer t.wg.Done()
+	ticker := time.NewTicker(diskWriteBackInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.done:
+			return
+		case now := <-ticker.C:
+			if err := t.writeBack(now.Add(-diskHandleIdle)); err != nil {
+				fmt.Println("disktree write back:", err)
+			}
+		}
+	}
+}
+
+// 把修改过的handle写回树，最后一次使用早于idleBefore的handle写回后丢弃
+func (t *DiskTree) writeBack(idleBefore time.Time) error {
+	t.mu.Lock()
+	handles := make(map[string]*diskHandle, len(t.handles))
+	for key, h := range t.handles {
+		handles[key] = h
+	}
+	t.mu.Unlock()
+	for key, h := range handles {
+		if err := t.writeHandle(key, h, idleBefore); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 写回一个handle，正在被修改时等待修改完成
+// 调用方不能持有t.mu，先加记录锁再加t.mu，和router持有记录锁时调用Delete等方法的加锁顺序一致
+func (t *DiskTree) writeHandle(key string, h *diskHandle, idleBefore time.Time) error {
+	h.pair.Mu.RLock()
+	defer h.pair.Mu.RUnlock()
+	data, err := encodeDiskRecord(h.pair)
+	if err != nil {
+		return fmt.Errorf("%q: %w", key, err)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	// 已经被Put替换或者被Delete删除的handle不能再写回
+	if t.handles[key] != h {
+		return nil
+	}
+	if !bytes.Equal(data, h.written) {
+		if _, err := t.tree.Put(key, data); err != nil {
+			return diskErr(err)
+		}
+		h.written = data
+	}
+	if h.used.Before(idleBefore) {
+		delete(t.handles, key)
+	}
+	return nil
+}
+
+func encodeDiskRecord(d *DataPair) ([]byte, error) {
+	return json.Marshal(diskRecord{Value: d.Value, V: d.V, Update: d.Update, CreatedAt: d.CreatedAt.UnixNano(), ExpiresAt: d.ExpiresAt})
+}
+
+func decodeDiskRecord(key string, data []byte) (*DataPair, error) {
+	var r diskRecord
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, fmt.Errorf("disktree %q: %w", key, err)
+	}
+	return &DataPair{OriginKey: key, Value: r.Value, V: r.V, Update: r.Update, CreatedAt: time.Unix(0, r.CreatedAt), ExpiresAt: r.ExpiresAt}, nil
+}
+
+// 树关闭后返回的错误统一成ErrClosed
+func diskErr(err error) error {
+	if errors.Is(err, disktree.ErrClosed) {
+		return ErrClosed
+	}
+	return err
+}
+
+// 从有序数据批量写入，不创建handle
+func (t *DiskTree) Load(pairs iter.Seq[*DataPair]) error {
+	if err := t.check(); err != nil {
+		return err
+	}
+	for d := range pairs {
+		data, err := encodeDiskRecord(d)
+		if err != nil {
+			return err
+		}
+		if _, err := t.tree.Put(d.OriginKey, data); err != nil {
+			return diskErr(err)
+		}
+	}
+	return nil
+}
+
+// 插入操作，立即写入树，更新时保留原来的创建时间
+func (t *DiskTree) Put(key string, value interface{}, expiresAt int64) (*DataPair, error) {
+	if err := t.check(); err != nil {
+		return nil, err
+	}
+	pair := NewDataPair(key, value, expiresAt)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if h, ok := t.handles[key]; ok {
+		pair.CreatedAt = h.pair.CreatedAt
+	} else if old, ok, err := t.tree.Get(key); err != nil {
+		return nil, diskErr(err)
+	} else if ok {
+		d, err := decodeDiskRecord(key, old)
+		if err != nil {
+			return nil, err
+		}
+		pair.CreatedAt = d.CreatedAt
+	}
+	data, err := encodeDiskRecord(pair)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := t.tree.Put(key, data); err != nil {
+		return nil, diskErr(err)
+	}
+	t.handles[key] = &diskHandle{pair: pair, written: data, used: time.Now()}
+	return pair, nil
+}
+
+func (t *DiskTree) Delete(key string) error {
+	if err := t.check(); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	found, err := t.tree.Delete(key)
+	if err != nil {
+		return diskErr(err)
+	}
+	delete(t.handles, key)
+	if !found {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// 查找操作，内存中没有时从树中读出并保留
+func (t *DiskTree) Get(key string) (*DataPair, error) {
+	if err := t.check(); err != nil {
+		return nil, err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if h, ok := t.handles[key]; ok {
+		h.used = time.Now()
+		return h.pair, nil
+	}
+	data, ok, err := t.tree.Get(key)
+	if err != nil {
+		return nil, diskErr(err)
+	}
+	if !ok {
+		return nil, ErrNotFound
+	}
+	pair, err := decodeDiskRecord(key, data)
+	if err != nil {
+		return nil, err
+	}
+	t.handles[key] = &diskHandle{pair: pair, written: data, used: time.Now()}
+	return pair, nil
+}
+
+func (t *DiskTree) Len() int {
+	return t.tree.Len()
+}
+
+// 寻找需要gossip传播的数据，内存中的数据加记录锁修改后写回，只在树中的数据直接改写
+func (t *DiskTree) GossipUpdate() []GossipUpdateData {
+	var g []GossipUpdateData
+	err := t.tree.Ascend(func(key string, _ []byte) bool {
+		t.mu.Lock()
+		h, ok := t.handles[key]
+		if !ok {
+			err := t.clearUpdate(key, &g)
+			t.mu.Unlock()
+			if err != nil {
+				fmt.Println("disktree gossip:", err)
+			}
+			return true
+		}
+		t.mu.Unlock()
+		d := h.pair
+		d.Mu.Lock()
+		update := d.Update
+		if update {
+			g = append(g, GossipUpdateData{Key: d.OriginKey, Value: d.Value, V: d.V, ExpiresAt: d.ExpiresAt})
+			d.Update = false
+		}
+		d.Mu.Unlock()
+		if update {
+			if err := t.writeHandle(key, h, time.Time{}); err != nil {
+				fmt.Println("disktree gossip:", err)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		fmt.Println("disktree gossip:", err)
+	}
+	return g
+}
+
+// 调用方持有t.mu，重新读取树中的数据，需要传播时加入g并清除标记
+func (t *DiskTree) clearUpdate(key string, g *[]GossipUpdateData) error {
+	data, ok, err := t.tree.Get(key)
+	if err != nil || !ok {
+		return err
+	}
+	d, err := decodeDiskRecord(key, data)
+	if err != nil || !d.Update {
+		return err
+	}
+	*g = append(*g, GossipUpdateData{Key: key, Value: d.Value, V: d.V, ExpiresAt: d.ExpiresAt})
+	d.Update = false
+	if data, err = encodeDiskRecord(d); err != nil {
+		return err
+	}
+	_, err = t.tree.Put(key, data)
+	return err
+}
+
+func (t *DiskTree) Iterate(fn func(d *DataPair) bool) error {
+	return t.Ascend("", fn)
+}
+
+// 顺序遍历，fn在不持有任何锁时调用
+// 内存中有的数据返回handle，其他的是从树中解码出的拷贝，修改它不会写回
+func (t *DiskTree) Ascend(start string, fn func(d *DataPair) bool) error {
+	if err := t.check(); err != nil {
+		return err
+	}
+	return t.visit(fn, func(visit func(key string, data []byte) bool) error {
+		return t.tree.AscendGreaterOrEqual(start, visit)
+	})
+}
+
+// 倒序遍历，start为空时从最大的key开始
+func (t *DiskTree) Descend(start string, fn func(d *DataPair) bool) error {
+	if err := t.check(); err != nil {
+		return err
+	}
+	return t.visit(fn, func(visit func(key string, data []byte) bool) error {
+		if start == "" {
+			return t.tree.Descend(visit)
+		}
+		return t.tree.DescendLessOrEqual(start, visit)
+	})
+}
+
+// 把树的遍历转换成DataPair的遍历
+func (t *DiskTree) visit(fn func(d *DataPair) bool, walk func(visit func(key string, data []byte) bool) error) error {
+	var decodeErr error
+	err := walk(func(key string, data []byte) bool {
+		t.mu.Lock()
+		h, ok := t.handles[key]
+		if ok {
+			h.used = time.Now()
+		}
+		t.mu.Unlock()
+		if ok {
+			return fn(h.pair)
+		}
+		d, err := decodeDiskRecord(key, data)
+		if err != nil {
+			decodeErr = err
+			return false
+		}
+		return fn(d)
+	})
+	if err != nil {
+		return diskErr(err)
+	}
+	return decodeErr
+}
+
+func (t *DiskTree) Range(start string, end string, limit int) ([]*DataPair, error) {
+	return collectRange(t.Ascend, start, end, limit)
+}
+
+func (t *DiskTree) Snapshot() ([]Entry, error) {
+	return collectEntries(t.Ascend)
+}
+
+// 树的高度、页数和页缓存的命中情况
+func (t *DiskTree) Stats() map[string]interface{} {
+	s, err := t.tree.Stats()
+	if err != nil {
+		return map[string]interface{}{"error": err.Error()}
+	}
+	t.mu.Lock()
+	handles := len(t.handles)
+	t.mu.Unlock()
+	return map[string]interface{}{
+		"file":         t.path,
+		"height":       s.Height,
+		"keys":         s.Keys,
+		"pages":        s.Pages,
+		"free_pages":   s.FreePages,
+		"cache_pages":  s.CachePages,
+		"dirty_pages":  s.DirtyPages,
+		"cache_hits":   s.CacheHits,
+		"cache_misses": s.CacheMisses,
+		"evictions":    s.Evictions,
+		"page_writes":  s.PageWrites,
+		"handles":      handles,
+	}
+}
+
+// 文件是上次正常关闭时留下的，返回当时保存的AOF序列号
+func (t *DiskTree) PersistedSeq() (uint64, bool) {
+	return t.tree.Seq(), t.reused
+}
+
+// 关闭时和数据一起保存的AOF序列号
+func (t *DiskTree) SetPersistedSeq(seq uint64) {
+	t.tree.SetSeq(seq)
+}
+
+// 检查树的结构是否正确
+func (t *DiskTree) Validate() error {
+	return t.tree.Validate()
+}
+
+// 写回所有handle后关闭树
+func (t *DiskTree) Close() error {
+	if t.closed.Swap(true) {
+		return nil
+	}
+	close(t.done)
+	t.wg.Wait()
+	err := t.writeBack(time.Now().Add(time.Hour))
+	if cerr := t.tree.Close(); err == nil {
+		err = cerr
+	}
+	if t.temp {
+		if rerr := os.Remove(t.path); err == nil {
+			err = rerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,133 @@
+package model
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+	"wr_2/disktree"
+)
+
+// 正常关闭之后重新打开时直接使用文件中的数据，handle中的修改在关闭时写回
+func TestDiskTreeReuse(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "disktree.db")
+	ds, err := OpenDiskTree(path, 16, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ds.PersistedSeq(); ok {
+		t.Fatal("new file has persisted data")
+	}
+	ds.Put("a", "1", 0)
+	ds.Put("b", "2", 0)
+	d, err := ds.Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Mu.Lock()
+	d.Value = "changed"
+	d.V = 5
+	d.Mu.Unlock()
+	ds.SetPersistedSeq(7)
+	if err := ds.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	ds, err = OpenDiskTree(path, 16, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+	if seq, ok := ds.PersistedSeq(); !ok || seq != 7 {
+		t.Fatalf("PersistedSeq = %d, %v, want 7, true", seq, ok)
+	}
+	if d, err := ds.Get("a"); err != nil || d.Value != "changed" || d.V != 5 {
+		t.Fatalf("Get(a) = %v, %v", d, err)
+	}
+	if ds.Len() != 2 {
+		t.Fatalf("Len %d, want 2", ds.Len())
+	}
+}
+
+// 上次没有正常关闭的文件和日志对不上，清空之后重新开始
+func TestDiskTreeDiscardsUncleanFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "disktree.db")
+	tree, err := disktree.Open(path, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree.Put("a", []byte(`{"Value":"1"}`))
+	if err := tree.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	ds, err := OpenDiskTree(path, 16, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+	if _, ok := ds.PersistedSeq(); ok || ds.Len() != 0 {
+		t.Fatalf("unclean file was reused with %d keys", ds.Len())
+	}
+}
+
+// 关闭时有handle正在被修改，等修改完成后写回，不会跳过
+func TestDiskTreeCloseWaitsForBusyHandle(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "disktree.db")
+	ds, err := OpenDiskTree(path, 16, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds.Put("a", "1", 0)
+	d, _ := ds.Get("a")
+	d.Mu.Lock()
+	closed := make(chan error)
+	go func() { closed <- ds.Close() }()
+	time.Sleep(20 * time.Millisecond)
+	d.Value = "changed"
+	d.Mu.Unlock()
+	if err := <-closed; err != nil {
+		t.Fatal(err)
+	}
+
+	ds, err = OpenDiskTree(path, 16, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+	if d, err := ds.Get("a"); err != nil || d.Value != "changed" {
+		t.Fatalf("Get(a) = %v, %v", d, err)
+	}
+}
+
+// 遍历时访问到的handle刷新使用时间，不会被当作空闲丢弃；写回之后修改仍然保存在树中
+func TestDiskTreeIterateKeepsHandle(t *testing.T) {
+	ds, err := OpenDiskTree(filepath.Join(t.TempDir(), "disktree.db"), 16, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+	ds.Put("a", "1", 0)
+	ds.Put("b", "2", 0)
+	for _, k := range []string{"a", "b"} {
+		d, _ := ds.Get(k)
+		d.Mu.Lock()
+		d.Value = k + "-changed"
+		d.Mu.Unlock()
+		ds.handles[k].used = time.Now().Add(-time.Hour)
+	}
+	ds.Ascend("a", func(d *DataPair) bool { return d.OriginKey < "a" })
+	if err := ds.writeBack(time.Now().Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ds.handles["a"]; !ok {
+		t.Fatal("handle visited by Ascend was dropped")
+	}
+	if _, ok := ds.handles["b"]; ok {
+		t.Fatal("idle handle was kept")
+	}
+	for _, k := range []string{"a", "b"} {
+		data, _, _ := ds.tree.Get(k)
+		if d, err := decodeDiskRecord(k, data); err != nil || d.Value != k+"-changed" {
+			t.Fatalf("%s on disk: %v, %v", k, d, err)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package model
+
+import "sync/atomic"
+
+// 各个引擎共用的辅助实现
+
+// 记录引擎是否已经关闭，嵌入到各个引擎中
+type closer struct {
+	closed atomic.Bool
+}
+
+func (c *closer) Close() error {
+	c.closed.Store(true)
+	return nil
+}
+
+func (c *closer) check() error {
+	if c.closed.Load() {
+		return ErrClosed
+	}
+	return nil
+}
+
+// 用有序遍历实现范围查询，各个引擎共用
+func collectRange(ascend func(start string, fn func(d *DataPair) bool) error, start string, end string, limit int) ([]*DataPair, error) {
+	var result []*DataPair
+	if limit <= 0 {
+		return result, nil
+	}
+	err := ascend(start, func(d *DataPair) bool {
+		if end != "" && d.OriginKey > end {
+			return false
+		}
+		result = append(result, d)
+		return len(result) < limit
+	})
+	return result, err
+}
+
+// 用有序遍历实现快照，各个引擎共用
+func collectEntries(ascend func(start string, fn func(d *DataPair) bool) error) ([]Entry, error) {
+	var entries []Entry
+	err := ascend("", func(d *DataPair) bool {
+		entries = append(entries, d.Entry())
+		return true
+	})
+	return entries, err
+}
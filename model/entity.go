@@ -1,48 +1,190 @@
 package model
 
 import (
-	"time"
+	"sort"
+	"sync"
 	"wr_2/utils"
 )
 
 // 使用go的map结构实现的数据结构
+// key先hash成int，不同的key可能hash到同一个值，所以每个hash值对应一个冲突切片，切片里按原始key区分
+// 用一个读写锁保护整个map，快照和日志重写不持有全局锁遍历时也不会和写入冲突
 
 type MapEntity struct {
-	Entities map[int]*DataPair
+	closer
+	mu       sync.RWMutex
+	Entities map[int][]*DataPair
+	length   int
+}
+
+func init() {
+	Register("Map", func(Config) (DataStruct, error) {
+		return InitMap(), nil
+	})
 }
 
 func InitMap() *MapEntity {
-	return &MapEntity{make(map[int]*DataPair)}
+	return &MapEntity{Entities: make(map[int][]*DataPair)}
 }
 
 func (m *MapEntity) Len() int {
-	return len(m.Entities)
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.length
 }
 func (m *MapEntity) GossipUpdate() []GossipUpdateData {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 	var g []GossipUpdateData
-	for _, v := range m.Entities {
-		if v.Update {
-			g = append(g, GossipUpdateData{Key: v.OriginKey, Value: v.Value, V: v.V})
-			v.Update = false
+	for _, bucket := range m.Entities {
+		for _, v := range bucket {
+			v.Mu.Lock()
+			if v.Update {
+				g = append(g, GossipUpdateData{Key: v.OriginKey, Value: v.Value, V: v.V, ExpiresAt: v.ExpiresAt})
+				v.Update = false
+			}
+			v.Mu.Unlock()
 		}
 	}
 	return g
 }
-func (m *MapEntity) Insert(id int, value interface{}, originKey string) {
-	m.Entities[id] = &DataPair{OriginKey: originKey, Value: value, V: time.Now().UnixNano(), Update: true}
+func (m *MapEntity) Put(originKey string, value interface{}, expiresAt int64) (*DataPair, error) {
+	if err := m.check(); err != nil {
+		return nil, err
+	}
+	pair := NewDataPair(originKey, value, expiresAt)
+	id := utils.ToHash(originKey)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	bucket := m.Entities[id]
+	if i := bucketIndex(bucket, originKey); i >= 0 {
+		pair.CreatedAt = bucket[i].CreatedAt
+		bucket[i] = pair
+		return pair, nil
+	}
+	m.Entities[id] = append(bucket, pair)
+	m.length++
+	return pair, nil
 }
-func (m *MapEntity) Delete(id int, key string) bool {
-	if _, ok := m.Entities[id]; !ok {
-		return false
+func (m *MapEntity) Delete(key string) error {
+	if err := m.check(); err != nil {
+		return err
+	}
+	id := utils.ToHash(key)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	bucket := m.Entities[id]
+	i := bucketIndex(bucket, key)
+	if i < 0 {
+		return ErrNotFound
+	}
+	if len(bucket) == 1 {
+		delete(m.Entities, id)
+	} else {
+		m.Entities[id] = append(bucket[:i:i], bucket[i+1:]...)
+	}
+	m.length--
+	return nil
+}
+func (m *MapEntity) Get(key string) (*DataPair, error) {
+	if err := m.check(); err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	bucket := m.Entities[utils.ToHash(key)]
+	i := bucketIndex(bucket, key)
+	if i < 0 {
+		return nil, ErrNotFound
 	}
-	delete(m.Entities, id)
-	return true
+	return bucket[i], nil
+
 }
-func (m *MapEntity) Search(key string) (*DataPair, int, bool) {
-	intKey := utils.ToHash(key)
-	if _, ok := m.Entities[intKey]; !ok {
-		return nil, -1, false
+
+// 在冲突切片中查找原始key，找不到返回-1
+func bucketIndex(bucket []*DataPair, key string) int {
+	for i, d := range bucket {
+		if d.OriginKey == key {
+			return i
+		}
 	}
-	return m.Entities[intKey], -1, true
+	return -1
+}
 
+func (m *MapEntity) Iterate(fn func(d *DataPair) bool) error {
+	return m.Ascend("", fn)
+}
+
+// map本身无序，遍历时先筛选出不小于start的数据再按key排序，调用fn时不持有锁
+func (m *MapEntity) Ascend(start string, fn func(d *DataPair) bool) error {
+	if err := m.check(); err != nil {
+		return err
+	}
+	var sorted []*DataPair
+	m.mu.RLock()
+	for _, bucket := range m.Entities {
+		for _, v := range bucket {
+			if v.OriginKey >= start {
+				sorted = append(sorted, v)
+			}
+		}
+	}
+	m.mu.RUnlock()
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].OriginKey < sorted[j].OriginKey
+	})
+	for _, v := range sorted {
+		if !fn(v) {
+			return nil
+		}
+	}
+	return nil
+}
+
+func (m *MapEntity) Descend(start string, fn func(d *DataPair) bool) error {
+	if err := m.check(); err != nil {
+		return err
+	}
+	var sorted []*DataPair
+	m.mu.RLock()
+	for _, bucket := range m.Entities {
+		for _, v := range bucket {
+			if start == "" || v.OriginKey <= start {
+				sorted = append(sorted, v)
+			}
+		}
+	}
+	m.mu.RUnlock()
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].OriginKey > sorted[j].OriginKey
+	})
+	for _, v := range sorted {
+		if !fn(v) {
+			return nil
+		}
+	}
+	return nil
+}
+
+func (m *MapEntity) Range(start string, end string, limit int) ([]*DataPair, error) {
+	return collectRange(m.Ascend, start, end, limit)
+}
+
+func (m *MapEntity) Snapshot() ([]Entry, error) {
+	return collectEntries(m.Ascend)
+}
+
+// 数据数量、hash值数量和最长的冲突切片
+func (m *MapEntity) Stats() map[string]interface{} {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	longest := 0
+	for _, bucket := range m.Entities {
+		longest = max(longest, len(bucket))
+	}
+	return map[string]interface{}{
+		"keys":           m.length,
+		"buckets":        len(m.Entities),
+		"longest_bucket": longest,
+	}
 }
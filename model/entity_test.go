@@ -0,0 +1,86 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"wr_2/utils"
+)
+
+// 找两个hash值相同的key
+func collidingKeys() (string, string) {
+	seen := map[int]string{}
+	for i := 0; ; i++ {
+		k := fmt.Sprintf("k%d", i)
+		if prev, ok := seen[utils.ToHash(k)]; ok {
+			return prev, k
+		}
+		seen[utils.ToHash(k)] = k
+	}
+}
+
+// hash冲突的key各自保存，查找时按原始key区分，删除一个不影响另一个
+func TestMapEntityCollisions(t *testing.T) {
+	a, b := collidingKeys()
+	m := InitMap()
+	defer m.Close()
+	m.Put(a, "a", 0)
+	m.Put(b, "b", 0)
+	if m.Len() != 2 {
+		t.Fatalf("Len %d, want 2", m.Len())
+	}
+	for k, want := range map[string]string{a: "a", b: "b"} {
+		d, err := m.Get(k)
+		if err != nil || d.OriginKey != k || d.Value != want {
+			t.Fatalf("Get(%q) = %v, %v", k, d, err)
+		}
+	}
+	if err := m.Delete(a); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Get(a); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get(%q) after delete: %v", a, err)
+	}
+	if d, err := m.Get(b); err != nil || d.Value != "b" {
+		t.Fatalf("Get(%q) = %v, %v", b, d, err)
+	}
+	if m.Len() != 1 {
+		t.Fatalf("Len %d, want 1", m.Len())
+	}
+}
+
+// 快照和日志重写不持有全局锁遍历，遍历必须能和写入并发执行
+func TestMapEntityIterateDuringWrites(t *testing.T) {
+	m := InitMap()
+	defer m.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 2000; i++ {
+			k := fmt.Sprintf("k%d", i%300)
+			if i%3 == 0 {
+				m.Delete(k)
+			} else {
+				m.Put(k, i, 0)
+			}
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		prev := ""
+		m.Iterate(func(d *DataPair) bool {
+			if d.OriginKey <= prev {
+				t.Errorf("Iterate: %q after %q", d.OriginKey, prev)
+			}
+			prev = d.OriginKey
+			return true
+		})
+		m.Descend("", func(d *DataPair) bool { return true })
+		m.GossipUpdate()
+		m.Len()
+	}
+}
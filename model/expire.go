@@ -0,0 +1,80 @@
+package model
+
+import (
+	"container/heap"
+	"sync"
+)
+
+// 按过期时间排序的最小堆，用于后台主动删除过期数据
+// 每个key最多一条记录，重新设置过期时间时原地调整，取出后需要再和存储的数据对比确认是否真的过期
+type ExpireQueue struct {
+	mu    sync.Mutex
+	items expireHeap
+	// key在堆中的下标
+	index map[string]int
+}
+
+func NewExpireQueue() *ExpireQueue {
+	q := &ExpireQueue{index: make(map[string]int)}
+	q.items.index = q.index
+	return q
+}
+
+// 设置key的过期时间，已经在队列中时更新原来的记录，expiresAt为0表示永不过期，从队列中移除
+func (q *ExpireQueue) Push(key string, expiresAt int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	i, ok := q.index[key]
+	switch {
+	case ok && expiresAt == 0:
+		heap.Remove(&q.items, i)
+	case ok:
+		q.items.data[i].ExpiresAt = expiresAt
+		heap.Fix(&q.items, i)
+	case expiresAt != 0:
+		heap.Push(&q.items, ExpiredData{Key: key, ExpiresAt: expiresAt})
+	}
+}
+
+// 取出最多limit个在now时刻之前到期的key
+func (q *ExpireQueue) PopExpired(now int64, limit int) []ExpiredData {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var expired []ExpiredData
+	for len(expired) < limit && len(q.items.data) > 0 && q.items.data[0].ExpiresAt <= now {
+		expired = append(expired, heap.Pop(&q.items).(ExpiredData))
+	}
+	return expired
+}
+
+func (q *ExpireQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items.data)
+}
+
+// 实现heap.Interface，移动元素时同步更新下标
+type expireHeap struct {
+	data  []ExpiredData
+	index map[string]int
+}
+
+func (h expireHeap) Len() int           { return len(h.data) }
+func (h expireHeap) Less(i, j int) bool { return h.data[i].ExpiresAt < h.data[j].ExpiresAt }
+func (h expireHeap) Swap(i, j int) {
+	h.data[i], h.data[j] = h.data[j], h.data[i]
+	h.index[h.data[i].Key] = i
+	h.index[h.data[j].Key] = j
+}
+func (h *expireHeap) Push(x interface{}) {
+	e := x.(ExpiredData)
+	h.index[e.Key] = len(h.data)
+	h.data = append(h.data, e)
+}
+func (h *expireHeap) Pop() interface{} {
+	n := len(h.data)
+	x := h.data[n-1]
+	h.data = h.data[:n-1]
+	delete(h.index, x.Key)
+	return x
+}
@@ -0,0 +1,36 @@
+package model
+
+import (
+	"fmt"
+	"testing"
+)
+
+// 同一个key反复设置过期时间只保留最后一次，取消过期时间时移出队列
+func TestExpireQueueOneEntryPerKey(t *testing.T) {
+	q := NewExpireQueue()
+	for i := 0; i < 1000; i++ {
+		q.Push(fmt.Sprintf("k%d", i%10), int64(1000-i))
+	}
+	if q.Len() != 10 {
+		t.Fatalf("Len %d, want 10", q.Len())
+	}
+	q.Push("k5", 0)
+	q.Push("k5", 0)
+	q.Push("k0", 5)
+	if q.Len() != 9 {
+		t.Fatalf("Len %d, want 9", q.Len())
+	}
+	got := q.PopExpired(8, 100)
+	want := []ExpiredData{{"k9", 1}, {"k8", 2}, {"k7", 3}, {"k6", 4}, {"k0", 5}, {"k4", 6}, {"k3", 7}, {"k2", 8}}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("PopExpired = %v, want %v", got, want)
+	}
+	if q.Len() != 1 {
+		t.Fatalf("Len %d, want 1", q.Len())
+	}
+	// 取出之后可以重新加入
+	q.Push("k9", 30)
+	if got := q.PopExpired(100, 100); fmt.Sprint(got) != fmt.Sprint([]ExpiredData{{"k1", 9}, {"k9", 30}}) {
+		t.Fatalf("PopExpired = %v", got)
+	}
+}
@@ -0,0 +1,56 @@
+package model
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// 读取配置的函数，和utils.ReadKey一样，key不存在时返回false
+type Config func(key string) (string, bool)
+
+// 引擎的构造函数，从配置中读取自己需要的参数，参数不合法时返回错误
+type Factory func(config Config) (DataStruct, error)
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]Factory{}
+)
+
+// 按名字注册引擎，一般在引擎所在文件的init中调用，名字重复时panic
+func Register(name string, factory Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if _, dup := registry[name]; dup {
+		panic("model: engine registered twice: " + name)
+	}
+	registry[name] = factory
+}
+
+// 按名字创建引擎，名字就是config.json中的dataStruct
+func Open(name string, config Config) (DataStruct, error) {
+	registryMu.RLock()
+	factory, ok := registry[name]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown dataStruct %q, registered: %v", name, Engines())
+	}
+	return factory(config)
+}
+
+// 所有已注册的引擎名字，按字典序排列
+func Engines() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// 没有任何配置，所有参数使用默认值
+func NoConfig(string) (string, bool) {
+	return "", false
+}
@@ -0,0 +1,198 @@
+package model
+
+import (
+	"hash/fnv"
+	"sort"
+	"sync"
+)
+
+// 分片的map，按原始key字符串存储，不会有hash冲突覆盖的问题
+// 数据按key的hash分到多个分片，每个分片有自己的读写锁，不同分片的操作可以并发执行，不依赖外部的全局锁
+
+// 分片数量，取2的幂方便用位运算取模
+const shardCount = 32
+
+type ShardedMap struct {
+	closer
+	shards [shardCount]*mapShard
+}
+
+type mapShard struct {
+	mu       sync.RWMutex
+	entities map[string]*DataPair
+}
+
+func init() {
+	Register("ShardedMap", func(Config) (DataStruct, error) {
+		return NewShardedMap(), nil
+	})
+}
+
+func NewShardedMap() *ShardedMap {
+	s := &ShardedMap{}
+	for i := range s.shards {
+		s.shards[i] = &mapShard{entities: make(map[string]*DataPair)}
+	}
+	return s
+}
+
+// key所在的分片
+func (s *ShardedMap) shard(key string) *mapShard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return s.shards[h.Sum32()&(shardCount-1)]
+}
+
+func (s *ShardedMap) Put(key string, value interface{}, expiresAt int64) (*DataPair, error) {
+	if err := s.check(); err != nil {
+		return nil, err
+	}
+	pair := NewDataPair(key, value, expiresAt)
+	sh := s.shard(key)
+	sh.mu.Lock()
+	if old, ok := sh.entities[key]; ok {
+		pair.CreatedAt = old.CreatedAt
+	}
+	sh.entities[key] = pair
+	sh.mu.Unlock()
+	return pair, nil
+}
+
+func (s *ShardedMap) Delete(key string) error {
+	if err := s.check(); err != nil {
+		return err
+	}
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if _, ok := sh.entities[key]; !ok {
+		return ErrNotFound
+	}
+	delete(sh.entities, key)
+	return nil
+}
+
+func (s *ShardedMap) Get(key string) (*DataPair, error) {
+	if err := s.check(); err != nil {
+		return nil, err
+	}
+	sh := s.shard(key)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	d, ok := sh.entities[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return d, nil
+}
+
+func (s *ShardedMap) Len() int {
+	n := 0
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		n += len(sh.entities)
+		sh.mu.RUnlock()
+	}
+	return n
+}
+
+func (s *ShardedMap) GossipUpdate() []GossipUpdateData {
+	var g []GossipUpdateData
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		for _, v := range sh.entities {
+			v.Mu.Lock()
+			if v.Update {
+				g = append(g, GossipUpdateData{Key: v.OriginKey, Value: v.Value, V: v.V, ExpiresAt: v.ExpiresAt})
+				v.Update = false
+			}
+			v.Mu.Unlock()
+		}
+		sh.mu.RUnlock()
+	}
+	return g
+}
+
+func (s *ShardedMap) Iterate(fn func(d *DataPair) bool) error {
+	return s.Ascend("", fn)
+}
+
+// 各个分片分别筛选出不小于start的数据，合并后按key排序，遍历时不持有分片的锁
+func (s *ShardedMap) Ascend(start string, fn func(d *DataPair) bool) error {
+	if err := s.check(); err != nil {
+		return err
+	}
+	var sorted []*DataPair
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		for k, v := range sh.entities {
+			if k >= start {
+				sorted = append(sorted, v)
+			}
+		}
+		sh.mu.RUnlock()
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].OriginKey < sorted[j].OriginKey
+	})
+	for _, v := range sorted {
+		if !fn(v) {
+			return nil
+		}
+	}
+	return nil
+}
+
+func (s *ShardedMap) Descend(start string, fn func(d *DataPair) bool) error {
+	if err := s.check(); err != nil {
+		return err
+	}
+	var sorted []*DataPair
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		for k, v := range sh.entities {
+			if start == "" || k <= start {
+				sorted = append(sorted, v)
+			}
+		}
+		sh.mu.RUnlock()
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].OriginKey > sorted[j].OriginKey
+	})
+	for _, v := range sorted {
+		if !fn(v) {
+			return nil
+		}
+	}
+	return nil
+}
+
+func (s *ShardedMap) Range(start string, end string, limit int) ([]*DataPair, error) {
+	return collectRange(s.Ascend, start, end, limit)
+}
+
+func (s *ShardedMap) Snapshot() ([]Entry, error) {
+	return collectEntries(s.Ascend)
+}
+
+// 数据数量和最大、最小的分片，用来观察分片是否均匀
+func (s *ShardedMap) Stats() map[string]interface{} {
+	total, largest, smallest := 0, 0, -1
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		n := len(sh.entities)
+		sh.mu.RUnlock()
+		total += n
+		largest = max(largest, n)
+		if smallest < 0 || n < smallest {
+			smallest = n
+		}
+	}
+	return map[string]interface{}{
+		"keys":           total,
+		"shards":         shardCount,
+		"largest_shard":  largest,
+		"smallest_shard": smallest,
+	}
+}
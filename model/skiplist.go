@@ -0,0 +1,223 @@
+package model
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+)
+
+// 使用跳表实现的数据结构，和B+树一样按key的字典序有序
+// 写操作之间用互斥锁串行执行，读操作不加锁：节点的next指针和数据指针都是原子读写的，
+// 插入时先设置好新节点的next再从底层往上链接，删除时只修改前驱节点的指针，被删除节点的next保持不变，
+// 所以读操作在任何时刻看到的都是一个完整的链表
+
+const (
+	skipListMaxLevel = 32
+	// 每个节点有1/4的概率多一层
+	skipListP = 4
+)
+
+type skipNode struct {
+	key  string
+	pair atomic.Pointer[DataPair]
+	next []atomic.Pointer[skipNode]
+}
+
+type SkipList struct {
+	closer
+	mu     sync.Mutex // 写操作互斥
+	head   *skipNode
+	level  atomic.Int32 // 当前最高层数
+	length atomic.Int64
+}
+
+func init() {
+	Register("SkipList", func(Config) (DataStruct, error) {
+		return NewSkipList(), nil
+	})
+}
+
+func NewSkipList() *SkipList {
+	s := &SkipList{head: &skipNode{next: make([]atomic.Pointer[skipNode], skipListMaxLevel)}}
+	s.level.Store(1)
+	return s
+}
+
+func randomLevel() int {
+	level := 1
+	for level < skipListMaxLevel && rand.Intn(skipListP) == 0 {
+		level++
+	}
+	return level
+}
+
+// 找到第一个不小于key的节点，preds不为空时记录每一层最后一个小于key的节点
+func (s *SkipList) seek(key string, preds []*skipNode) *skipNode {
+	x := s.head
+	for i := int(s.level.Load()) - 1; i >= 0; i-- {
+		for {
+			n := x.next[i].Load()
+			if n == nil || n.key >= key {
+				break
+			}
+			x = n
+		}
+		if preds != nil {
+			preds[i] = x
+		}
+	}
+	return x.next[0].Load()
+}
+
+// 插入操作，返回存入跳表中的数据
+func (s *SkipList) Put(key string, value interface{}, expiresAt int64) (*DataPair, error) {
+	if err := s.check(); err != nil {
+		return nil, err
+	}
+	pair := NewDataPair(key, value, expiresAt)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	preds := make([]*skipNode, skipListMaxLevel)
+	for i := range preds {
+		preds[i] = s.head
+	}
+	if n := s.seek(key, preds); n != nil && n.key == key {
+		// 更新
+		pair.CreatedAt = n.pair.Load().CreatedAt
+		n.pair.Store(pair)
+		return pair, nil
+	}
+	level := randomLevel()
+	node := &skipNode{key: key, next: make([]atomic.Pointer[skipNode], level)}
+	node.pair.Store(pair)
+	for i := 0; i < level; i++ {
+		node.next[i].Store(preds[i].next[i].Load())
+	}
+	// 从底层往上链接，读操作只要在底层能找到就是完整的
+	for i := 0; i < level; i++ {
+		preds[i].next[i].Store(node)
+	}
+	if int32(level) > s.level.Load() {
+		s.level.Store(int32(level))
+	}
+	s.length.Add(1)
+	return pair, nil
+}
+
+func (s *SkipList) Delete(key string) error {
+	if err := s.check(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	preds := make([]*skipNode, skipListMaxLevel)
+	n := s.seek(key, preds)
+	if n == nil || n.key != key {
+		return ErrNotFound
+	}
+	// 从上往下摘除，被删除节点自己的next不变，正在读它的操作可以继续往后走
+	for i := len(n.next) - 1; i >= 0; i-- {
+		preds[i].next[i].Store(n.next[i].Load())
+	}
+	s.length.Add(-1)
+	return nil
+}
+
+func (s *SkipList) Get(key string) (*DataPair, error) {
+	if err := s.check(); err != nil {
+		return nil, err
+	}
+	n := s.seek(key, nil)
+	if n == nil || n.key != key {
+		return nil, ErrNotFound
+	}
+	return n.pair.Load(), nil
+}
+
+func (s *SkipList) Len() int {
+	return int(s.length.Load())
+}
+
+func (s *SkipList) GossipUpdate() []GossipUpdateData {
+	var g []GossipUpdateData
+	s.ascend("", func(d *DataPair) bool {
+		d.Mu.Lock()
+		if d.Update {
+			g = append(g, GossipUpdateData{Key: d.OriginKey, Value: d.Value, V: d.V, ExpiresAt: d.ExpiresAt})
+			d.Update = false
+		}
+		d.Mu.Unlock()
+		return true
+	})
+	return g
+}
+
+func (s *SkipList) Iterate(fn func(d *DataPair) bool) error {
+	return s.Ascend("", fn)
+}
+
+func (s *SkipList) Ascend(start string, fn func(d *DataPair) bool) error {
+	if err := s.check(); err != nil {
+		return err
+	}
+	s.ascend(start, fn)
+	return nil
+}
+
+// 找到第一个不小于start的节点，沿着底层链表顺序遍历
+func (s *SkipList) ascend(start string, fn func(d *DataPair) bool) {
+	for n := s.seek(start, nil); n != nil; n = n.next[0].Load() {
+		if !fn(n.pair.Load()) {
+			return
+		}
+	}
+}
+
+// 跳表只有向后的指针，每一步都从头找最后一个小于当前key的节点
+func (s *SkipList) Descend(start string, fn func(d *DataPair) bool) error {
+	if err := s.check(); err != nil {
+		return err
+	}
+	n := s.seekLast(func(k string) bool { return start == "" || k <= start })
+	for n != nil {
+		if !fn(n.pair.Load()) {
+			return nil
+		}
+		key := n.key
+		n = s.seekLast(func(k string) bool { return k < key })
+	}
+	return nil
+}
+
+// 找到最后一个满足before的节点，before要对一段前缀的key成立，没有时返回nil
+func (s *SkipList) seekLast(before func(k string) bool) *skipNode {
+	x := s.head
+	for i := int(s.level.Load()) - 1; i >= 0; i-- {
+		for {
+			n := x.next[i].Load()
+			if n == nil || !before(n.key) {
+				break
+			}
+			x = n
+		}
+	}
+	if x == s.head {
+		return nil
+	}
+	return x
+}
+
+func (s *SkipList) Range(start string, end string, limit int) ([]*DataPair, error) {
+	return collectRange(s.Ascend, start, end, limit)
+}
+
+func (s *SkipList) Snapshot() ([]Entry, error) {
+	return collectEntries(s.Ascend)
+}
+
+func (s *SkipList) Stats() map[string]interface{} {
+	return map[string]interface{}{
+		"keys":  s.Len(),
+		"level": s.level.Load(),
+	}
+}
@@ -1,17 +1,54 @@
 package model
 
 import (
+	"errors"
+	"iter"
 	"sync"
 	"time"
 )
 
-// 数据结构，实现了两种，一种是B+树，在代码中使用这个，一种是go的map
+var (
+	ErrNotFound = errors.New("key not found")
+	ErrClosed   = errors.New("data struct is closed")
+)
+
+// 存储引擎接口，实现了五种：B+树、磁盘上的B+树、go的map、分片加锁的map和跳表，通过Register按名字注册
+// 关闭之后所有返回error的方法都返回ErrClosed
 type DataStruct interface {
-	Insert(intKey int, value interface{}, key string)
-	Delete(intKey int, key string) bool
-	Search(key string) (*DataPair, int, bool)
+	// 查找，不存在时返回ErrNotFound
+	Get(key string) (*DataPair, error)
+	// 插入或更新，expiresAt是过期时间的纳秒时间戳，0表示永不过期，返回存入的数据
+	Put(key string, value interface{}, expiresAt int64) (*DataPair, error)
+	// 删除，不存在时返回ErrNotFound
+	Delete(key string) error
 	Len() int
 	GossipUpdate() []GossipUpdateData
+	// 按key的字典序遍历所有数据，fn返回false时停止遍历
+	Iterate(fn func(d *DataPair) bool) error
+	// 从start开始按key的字典序遍历数据
+	Ascend(start string, fn func(d *DataPair) bool) error
+	// 从start开始按key的字典序倒序遍历不大于start的数据，start为空表示从最大的key开始
+	Descend(start string, fn func(d *DataPair) bool) error
+	// 按key的字典序返回[start, end]范围内的数据，start为空表示从头开始，end为空表示不设上界，最多返回limit条
+	Range(start string, end string, limit int) ([]*DataPair, error)
+	// 所有数据的拷贝，按key排序，用于持久化
+	Snapshot() ([]Entry, error)
+	// 引擎自己的统计信息
+	Stats() map[string]interface{}
+	Close() error
+}
+
+// 可以从有序数据批量构建的引擎实现这个接口，启动加载时代替逐条Put，只能在空的引擎上、没有其他操作时调用
+type BulkLoader interface {
+	Load(pairs iter.Seq[*DataPair]) error
+}
+
+// 数据保存在文件中、正常关闭之后重启时可以直接使用的引擎实现这个接口
+type Durable interface {
+	// 上次正常关闭时保存的日志序列号，ok为false表示没有可以直接使用的数据
+	PersistedSeq() (seq uint64, ok bool)
+	// 设置关闭时和数据一起保存的日志序列号，关闭前调用
+	SetPersistedSeq(seq uint64)
 }
 
 // 节点使用的结构体，V是版本好，用纳秒时间戳来表示，Update表示是否需要更新，只有需要更新且时间戳更新才会更新数据
@@ -22,21 +59,83 @@ type DataPair struct {
 	V         int64
 	Update    bool
 	CreatedAt time.Time
+	ExpiresAt int64 // 过期时间的纳秒时间戳，0表示永不过期
+}
+
+// 新写入的数据，版本号是当前的纳秒时间戳，需要gossip传播
+func NewDataPair(key string, value interface{}, expiresAt int64) *DataPair {
+	now := time.Now()
+	return &DataPair{OriginKey: key, Value: value, V: now.UnixNano(), Update: true, CreatedAt: now, ExpiresAt: expiresAt}
+}
+
+// 数据的拷贝，不带锁，Update表示还没有通过gossip传播
+type Entry struct {
+	Key       string
+	Value     interface{}
+	V         int64
+	ExpiresAt int64
+	Update    bool `json:",omitempty"`
+}
+
+// 加记录锁复制数据
+func (d *DataPair) Entry() Entry {
+	d.Mu.RLock()
+	defer d.Mu.RUnlock()
+	return Entry{Key: d.OriginKey, Value: d.Value, V: d.V, ExpiresAt: d.ExpiresAt, Update: d.Update}
+}
+
+// 加记录锁读取过期时间
+func (d *DataPair) Expiry() int64 {
+	d.Mu.RLock()
+	defer d.Mu.RUnlock()
+	return d.ExpiresAt
+}
+
+// 加记录锁判断数据在now时刻是否已经过期，已经持有记录锁时先用Entry复制再判断
+func (d *DataPair) Expired(now int64) bool {
+	return expired(d.Expiry(), now)
+}
+
+// 判断拷贝的数据在now时刻是否已经过期
+func (e Entry) Expired(now int64) bool {
+	return expired(e.ExpiresAt, now)
+}
+
+func expired(expiresAt int64, now int64) bool {
+	return expiresAt != 0 && expiresAt <= now
 }
 
 // 用于gossip传播的结构体
+// 过期时间以绝对时间戳传播，保证所有节点在同一时刻过期
 type GossipUpdateData struct {
-	Key   string
-	Value interface{}
-	V     int64
+	Key       string
+	Value     interface{}
+	V         int64
+	ExpiresAt int64
 }
+
+// Delete是过期删除的key，带着删除时的过期时间，接收方只删除过期时间相同或者本地也已经过期的数据，不会删掉之后的写入
 type GossipAllData struct {
 	Update []GossipUpdateData
-	Delete []string
+	Delete []ExpiredData
+	Txn    []GossipTxn
+}
+
+// 事务的gossip传播结构体，一个事务的所有操作作为整体传播，接收方在同一次加锁中全部应用
+// V是事务提交时的版本号，事务写入的所有key都使用这个版本号
+type GossipTxn struct {
+	V   int64
+	Ops []GossipTxnOp
+}
+type GossipTxnOp struct {
+	Key       string
+	Value     interface{}
+	ExpiresAt int64
+	Delete    bool
 }
 
 // 过期删除结构体
 type ExpiredData struct {
 	Key       string
-	CreatedAt time.Time
+	ExpiresAt int64
 }
@@ -0,0 +1,357 @@
+package persist
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"wr_2/model"
+)
+
+// fsync策略
+type FsyncPolicy int
+
+const (
+	FsyncAlways   FsyncPolicy = iota // 每次写入都fsync，最安全也最慢
+	FsyncEverySec                    // 每秒fsync一次，崩溃时最多丢一秒的数据
+	FsyncNo                          // 不主动fsync，交给操作系统
+)
+
+// 解析config中的appendfsync：always、everysec、no
+func ParseFsyncPolicy(s string) (FsyncPolicy, error) {
+	switch s {
+	case "always":
+		return FsyncAlways, nil
+	case "everysec":
+		return FsyncEverySec, nil
+	case "no":
+		return FsyncNo, nil
+	}
+	return 0, fmt.Errorf("appendfsync must be always, everysec or no, got %q", s)
+}
+
+// 日志中的一条记录，写入数据结构之前先写日志，Seq是本节点递增的序列号
+// put记录的是写入后的完整状态，重放时直接覆盖，Update表示这次写入还需要gossip传播，delete删除Key
+// txn是本节点的一个事务，gossip是收到的一批gossip数据，都作为一条记录写入，重放时要么全部应用要么全部丢弃
+// seq只记录序列号，重写后的日志以它开头，保证序列号在重写后继续递增
+type Record struct {
+	Seq       uint64
+	Op        string
+	Key       string               `json:",omitempty"`
+	Value     interface{}          `json:",omitempty"`
+	V         int64                `json:",omitempty"`
+	ExpiresAt int64                `json:",omitempty"`
+	Update    bool                 `json:",omitempty"`
+	Txn       *model.GossipTxn     `json:",omitempty"`
+	Gossip    *model.GossipAllData `json:",omitempty"`
+}
+
+// 已经有重写在执行
+var ErrRewriteInProgress = errors.New("aof rewrite already in progress")
+
+// 追加写入的日志文件
+type AOF struct {
+	mu       sync.Mutex
+	path     string
+	f        *os.File
+	policy   FsyncPolicy
+	dirty    bool // 有写入还没有fsync
+	buf      []byte
+	done     chan struct{}
+	closed   bool
+	seq      uint64 // 最后一条记录的序列号
+	size     int64  // 当前文件大小
+	baseSize int64  // 打开或者上次重写后的文件大小，用来判断是否需要重写
+	err      error  // 写入失败并且无法确定文件内容时记录错误，之后的写入都返回这个错误
+
+	// 重写期间追加的记录同时保存在rewriteBuf，重写结束时接到新文件后面
+	rewriting  bool
+	rewriteBuf []byte
+}
+
+// 打开日志文件用于追加，文件不存在时创建，everysec策略会启动后台fsync
+// seq是重放得到的最后一个序列号，新的记录从它的下一个开始
+func OpenAOF(path string, policy FsyncPolicy, seq uint64) (*AOF, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	a := &AOF{path: path, f: f, policy: policy, done: make(chan struct{}), seq: seq, size: info.Size(), baseSize: info.Size()}
+	if policy == FsyncEverySec {
+		go a.syncEverySecond()
+	}
+	return a, nil
+}
+
+// 追加一条记录并分配序列号，返回记录的序列号，always策略在返回前fsync
+// 写入失败时截掉写了一半的记录，序列号不会被占用；截断失败或者fsync失败时文件中是否有这条记录无法确定，日志进入失败状态，之后的写入都返回错误
+func (a *AOF) Append(r Record) (uint64, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return 0, os.ErrClosed
+	}
+	if a.err != nil {
+		return 0, a.err
+	}
+	r.Seq = a.seq + 1
+	buf, err := appendFrame(a.buf[:0], r)
+	if err != nil {
+		return 0, err
+	}
+	a.buf = buf
+	if _, err := a.f.Write(buf); err != nil {
+		if terr := a.f.Truncate(a.size); terr != nil {
+			a.err = fmt.Errorf("aof write failed and could not be rolled back: %w", terr)
+		}
+		return 0, err
+	}
+	if a.policy == FsyncAlways {
+		if err := a.f.Sync(); err != nil {
+			// fsync失败后不能再相信页缓存中的数据，尽量截掉这条记录，序列号也不再分配
+			a.f.Truncate(a.size)
+			a.err = fmt.Errorf("aof fsync failed: %w", err)
+			return 0, err
+		}
+	}
+	// 写入成功之后才放进重写缓冲区，失败的记录不会出现在新文件中
+	if a.rewriting {
+		a.rewriteBuf = append(a.rewriteBuf, buf...)
+	}
+	a.size += int64(len(buf))
+	a.dirty = a.policy != FsyncAlways
+	a.seq = r.Seq
+	return r.Seq, nil
+}
+
+// 最后一条记录的序列号
+func (a *AOF) Seq() uint64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.seq
+}
+
+func (a *AOF) syncEverySecond() {
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-a.done:
+			return
+		case <-t.C:
+			a.mu.Lock()
+			if a.dirty && !a.closed {
+				if err := a.f.Sync(); err != nil {
+					fmt.Println("aof fsync:", err)
+				}
+				a.dirty = false
+			}
+			a.mu.Unlock()
+		}
+	}
+}
+
+// 当前文件大小和上次重写后的大小
+func (a *AOF) Size() (size int64, baseSize int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.size, a.baseSize
+}
+
+// 重写日志，dump通过add写入当前所有数据，写完之后把重写期间追加的记录接到后面，再原子地替换原来的文件
+// dump执行期间不持有日志的锁，写入可以继续追加，返回dump写入的记录数
+// 写入方先写日志再修改数据，lock是它们写入时持有的锁，开始重写时加上它，保证序列号不大于重写起点的记录都已经应用，dump能看到它们的效果
+func (a *AOF) Rewrite(lock sync.Locker, dump func(add func(r Record) error) error) (int, error) {
+	lock.Lock()
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		lock.Unlock()
+		return 0, os.ErrClosed
+	}
+	if a.rewriting {
+		a.mu.Unlock()
+		lock.Unlock()
+		return 0, ErrRewriteInProgress
+	}
+	if a.err != nil {
+		a.mu.Unlock()
+		lock.Unlock()
+		return 0, a.err
+	}
+	a.rewriting = true
+	a.rewriteBuf = nil
+	base := a.seq
+	a.mu.Unlock()
+	lock.Unlock()
+
+	tmp := a.path + ".rewrite"
+	count, err := a.writeRewrite(tmp, base, dump)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err == nil {
+		err = a.finishRewrite(tmp)
+	}
+	a.rewriting = false
+	a.rewriteBuf = nil
+	if err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	return count, nil
+}
+
+// 把dump的数据写到临时文件，开头是重写开始时的序列号，dump的记录都使用这个序列号
+// dump的数据可能已经包含了序列号更大的记录的效果，这些记录在重写缓冲区中会再重放一次，重放结果不变
+func (a *AOF) writeRewrite(tmp string, base uint64, dump func(add func(r Record) error) error) (int, error) {
+	f, err := os.Create(tmp)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	frame, err := appendFrame(nil, Record{Seq: base, Op: "seq"})
+	if err != nil {
+		return 0, err
+	}
+	if _, err := w.Write(frame); err != nil {
+		return 0, err
+	}
+	count := 0
+	err = dump(func(r Record) error {
+		r.Seq = base
+		var err error
+		if frame, err = appendFrame(frame[:0], r); err != nil {
+			return err
+		}
+		count++
+		_, err = w.Write(frame)
+		return err
+	})
+	if err == nil {
+		err = w.Flush()
+	}
+	return count, err
+}
+
+// 持有a.mu时调用，追加重写期间的记录，fsync之后替换原来的文件并切换到新文件继续追加
+func (a *AOF) finishRewrite(tmp string) error {
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(a.rewriteBuf)
+	if err == nil {
+		err = f.Sync()
+	}
+	var info os.FileInfo
+	if err == nil {
+		info, err = f.Stat()
+	}
+	if err == nil {
+		err = os.Rename(tmp, a.path)
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if err := syncDir(filepath.Dir(a.path)); err != nil {
+		fmt.Println("aof rewrite:", err)
+	}
+	// 旧文件已经被替换，之前的写入都在新文件里，直接关闭
+	a.f.Close()
+	a.f = f
+	a.dirty = false
+	a.size = info.Size()
+	a.baseSize = info.Size()
+	return nil
+}
+
+// fsync并关闭文件
+func (a *AOF) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return nil
+	}
+	a.closed = true
+	close(a.done)
+	err := a.f.Sync()
+	if cerr := a.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// 重放的结果
+type ReplayInfo struct {
+	Records   int    // 应用的记录数
+	Skipped   int    // 序列号不大于after、已经加载过的记录数
+	Seq       uint64 // 最后一条记录的序列号
+	Truncated int64  // 截掉的不完整记录的字节数
+}
+
+// 按顺序重放日志中完整的记录，只应用序列号大于after的记录，文件不存在时什么都不做
+// 最后一条记录写到一半时截掉不完整的部分，文件中间损坏或者序列号倒退时返回错误
+func ReplayAOF(path string, after uint64, apply func(r Record) error) (ReplayInfo, error) {
+	var info ReplayInfo
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return info, nil
+	}
+	if err != nil {
+		return info, err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return info, err
+	}
+	fr := newFrameReader(f, stat.Size())
+	for {
+		var r Record
+		offset := fr.offset
+		err := fr.next(&r)
+		if err == io.EOF {
+			return info, nil
+		}
+		if errors.Is(err, errTornTail) {
+			info.Truncated = stat.Size() - fr.offset
+			if err := f.Truncate(fr.offset); err != nil {
+				return info, err
+			}
+			return info, f.Sync()
+		}
+		if err != nil {
+			return info, fmt.Errorf("aof %s: %w", path, err)
+		}
+		if r.Seq < info.Seq {
+			return info, fmt.Errorf("aof %s: sequence goes backwards at offset %d: %d after %d", path, offset, r.Seq, info.Seq)
+		}
+		info.Seq = r.Seq
+		if r.Op == "seq" {
+			continue
+		}
+		if r.Seq <= after {
+			info.Skipped++
+			continue
+		}
+		if err := apply(r); err != nil {
+			return info, fmt.Errorf("aof %s: record %d: %w", path, r.Seq, err)
+		}
+		info.Records++
+	}
+}
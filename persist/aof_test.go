@@ -0,0 +1,65 @@
+package persist_test
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+	"wr_2/persist"
+)
+
+// 写入方持有lock先写日志再修改数据，重写开始时要等它修改完，否则已经写了日志但还没修改的数据既不在dump里也不在重写缓冲区里
+func TestRewriteWaitsForLoggedWrites(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	a, err := persist.OpenAOF(path, persist.FsyncNo, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lock sync.Mutex
+	var store sync.Map
+	logged, apply, applied := make(chan struct{}), make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(applied)
+		lock.Lock()
+		defer lock.Unlock()
+		if _, err := a.Append(persist.Record{Op: "put", Key: "a", Value: "1"}); err != nil {
+			t.Error(err)
+		}
+		close(logged)
+		<-apply
+		store.Store("a", "1")
+	}()
+	<-logged
+	rewritten := make(chan error)
+	go func() {
+		_, err := a.Rewrite(&lock, func(add func(r persist.Record) error) error {
+			var err error
+			store.Range(func(k, v any) bool {
+				err = add(persist.Record{Op: "put", Key: k.(string), Value: v})
+				return err == nil
+			})
+			return err
+		})
+		rewritten <- err
+	}()
+	// 重写不等待写入方时会在这段时间内完成
+	time.Sleep(50 * time.Millisecond)
+	close(apply)
+	<-applied
+	if err := <-rewritten; err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]interface{}{}
+	if _, err := persist.ReplayAOF(path, 0, func(r persist.Record) error {
+		got[r.Key] = r.Value
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if got["a"] != "1" {
+		t.Fatalf("after rewrite and replay: %v", got)
+	}
+}
@@ -0,0 +1,80 @@
+// 持久化文件的格式和读写
+// 每条记录是一帧：4字节的数据长度、4字节的crc32校验和，后面是json编码的数据，都是小端序
+// 写到一半崩溃时最后一帧不完整或者校验和不对，读取时可以识别出来
+
+package persist
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+const frameHeaderSize = 8
+
+// 最后一帧不完整，说明写到一半时崩溃了，之前的数据都是完整的
+var errTornTail = errors.New("torn record at end of file")
+
+// 把v编码成一帧追加到buf
+func appendFrame(buf []byte, v interface{}) ([]byte, error) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return buf, err
+	}
+	var header [frameHeaderSize]byte
+	binary.LittleEndian.PutUint32(header[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(header[4:8], crc32.ChecksumIEEE(payload))
+	buf = append(buf, header[:]...)
+	return append(buf, payload...), nil
+}
+
+// 顺序读取帧，remaining是从当前位置到文件末尾的字节数，用来区分末尾不完整和中间损坏
+type frameReader struct {
+	r         *bufio.Reader
+	offset    int64 // 已经完整读取的字节数
+	remaining int64
+}
+
+func newFrameReader(r io.Reader, size int64) *frameReader {
+	return &frameReader{r: bufio.NewReader(r), remaining: size}
+}
+
+// 读取下一帧并解码到v，没有数据时返回io.EOF，最后一帧不完整时返回errTornTail
+func (fr *frameReader) next(v interface{}) error {
+	if fr.remaining == 0 {
+		return io.EOF
+	}
+	if fr.remaining < frameHeaderSize {
+		return errTornTail
+	}
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(fr.r, header[:]); err != nil {
+		return err
+	}
+	length := int64(binary.LittleEndian.Uint32(header[0:4]))
+	sum := binary.LittleEndian.Uint32(header[4:8])
+	if frameHeaderSize+length > fr.remaining {
+		return errTornTail
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(fr.r, payload); err != nil {
+		return err
+	}
+	if crc32.ChecksumIEEE(payload) != sum {
+		// 校验和不对的帧正好是最后一帧时，是写到一半崩溃，否则是文件损坏
+		if frameHeaderSize+length == fr.remaining {
+			return errTornTail
+		}
+		return fmt.Errorf("checksum mismatch at offset %d", fr.offset)
+	}
+	if err := json.Unmarshal(payload, v); err != nil {
+		return fmt.Errorf("bad record at offset %d: %w", fr.offset, err)
+	}
+	fr.offset += frameHeaderSize + length
+	fr.remaining -= frameHeaderSize + length
+	return nil
+}
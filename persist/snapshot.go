@@ -0,0 +1,134 @@
+package persist
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"wr_2/model"
+)
+
+// 快照文件以魔数开头，接着是8字节的日志序列号，后面是gzip压缩的json数据，每条数据一个model.Entry
+// gzip结尾带有crc32校验和数据长度，文件不完整或者损坏时读取会失败
+var snapshotMagic = []byte("WR2SNAP2")
+
+// 写快照，数据先写到临时文件，Commit时fsync并改名，中途失败不会影响原来的快照
+type SnapshotWriter struct {
+	path  string
+	f     *os.File
+	buf   *bufio.Writer
+	gz    *gzip.Writer
+	enc   *json.Encoder
+	count int
+}
+
+// seq是开始快照时日志最后一条记录的序列号，这之前的记录都已经包含在快照里
+func CreateSnapshot(path string, seq uint64) (*SnapshotWriter, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return nil, err
+	}
+	w := &SnapshotWriter{path: path, f: f, buf: bufio.NewWriter(f)}
+	header := binary.LittleEndian.AppendUint64(append([]byte(nil), snapshotMagic...), seq)
+	if _, err := w.buf.Write(header); err != nil {
+		w.Abort()
+		return nil, err
+	}
+	w.gz = gzip.NewWriter(w.buf)
+	w.enc = json.NewEncoder(w.gz)
+	return w, nil
+}
+
+// 写入一条数据
+func (w *SnapshotWriter) Add(e model.Entry) error {
+	w.count++
+	return w.enc.Encode(e)
+}
+
+// 写入的数据条数
+func (w *SnapshotWriter) Count() int {
+	return w.count
+}
+
+// 完成快照，替换原来的快照文件
+func (w *SnapshotWriter) Commit() error {
+	err := w.gz.Close()
+	if err == nil {
+		err = w.buf.Flush()
+	}
+	if err == nil {
+		err = w.f.Sync()
+	}
+	if cerr := w.f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(w.f.Name(), w.path)
+	}
+	if err != nil {
+		os.Remove(w.f.Name())
+		return err
+	}
+	return syncDir(filepath.Dir(w.path))
+}
+
+// 放弃快照，删除临时文件
+func (w *SnapshotWriter) Abort() {
+	w.f.Close()
+	os.Remove(w.f.Name())
+}
+
+// 读取整个快照，校验通过后才返回数据和快照包含的日志序列号
+func ReadSnapshot(path string) ([]model.Entry, uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	magic := make([]byte, len(snapshotMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || !bytes.Equal(magic, snapshotMagic) {
+		return nil, 0, fmt.Errorf("snapshot %s: not a snapshot file", path)
+	}
+	b := make([]byte, 8)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, 0, fmt.Errorf("snapshot %s: %w", path, err)
+	}
+	seq := binary.LittleEndian.Uint64(b)
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, 0, fmt.Errorf("snapshot %s: %w", path, err)
+	}
+	dec := json.NewDecoder(gz)
+	var entries []model.Entry
+	for {
+		var e model.Entry
+		err := dec.Decode(&e)
+		if errors.Is(err, io.EOF) {
+			return entries, seq, nil
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("snapshot %s: %w", path, err)
+		}
+		entries = append(entries, e)
+	}
+}
+
+// 改名之后fsync目录，保证改名本身落盘
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,208 @@
+// 预写日志持久化，每次写入数据结构之前先把写入后的状态追加到日志文件，启动时按顺序重放恢复数据
+// 每条记录有本节点递增的序列号，收到的一批gossip数据和一个事务都只写一条记录，崩溃时要么全部重放要么全部丢弃
+// 每个节点使用自己的日志文件，config.json中没有配置aofDir时不开启
+// 日志超过一定大小后在后台用当前数据重写，每个key只保留一条记录
+
+package router
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"path/filepath"
+	"strconv"
+	"time"
+	"wr_2/model"
+	"wr_2/persist"
+	"wr_2/utils"
+)
+
+// 追加日志，没有开启时为nil
+var aof *persist.AOF
+
+// 重放本节点的日志中序列号大于after的记录，然后打开日志继续追加
+// 从快照恢复时after是快照包含的序列号，直接使用磁盘上的数据时是关闭时保存的序列号，之前的记录都已经加载
+func openAOF(port string, after uint64) error {
+	dir, ok := utils.ReadKey("aofDir")
+	if !ok {
+		return nil
+	}
+	policy := persist.FsyncEverySec
+	if s, ok := utils.ReadKey("appendfsync"); ok {
+		var err error
+		if policy, err = persist.ParseFsyncPolicy(s); err != nil {
+			return err
+		}
+	}
+	path := filepath.Join(dir, "appendonly-"+port+".aof")
+	start := time.Now()
+	info, err := persist.ReplayAOF(path, after, replayRecord)
+	if err != nil {
+		return err
+	}
+	if info.Truncated > 0 {
+		fmt.Printf("aof %s: dropped %d bytes of incomplete record at the end\n", path, info.Truncated)
+	}
+	fmt.Printf("aof %s: replayed %d records up to seq %d in %v, skipped %d already loaded\n", path, info.Records, info.Seq, time.Since(start), info.Skipped)
+	// 日志可能比快照旧，新的序列号要同时大于两者
+	aof, err = persist.OpenAOF(path, policy, max(info.Seq, after))
+	return err
+}
+
+// 重放一条日志，put直接覆盖成记录的状态，不比较版本号，日志的顺序就是写入的顺序
+// 本节点的写入恢复记录中的传播标记，本节点的事务重新加入gossip队列，崩溃前还没传播的写入在重启后继续传播
+// gossip和收到时一样按版本号应用，不再标记需要传播
+func replayRecord(r persist.Record) error {
+	switch r.Op {
+	case "put":
+		return putTxnKey(r.Key, r.Value, r.V, r.ExpiresAt, r.Update)
+	case "delete":
+		if err := m.Delete(r.Key); err != nil && !errors.Is(err, model.ErrNotFound) {
+			return err
+		}
+		return nil
+	case "txn":
+		if r.Txn == nil {
+			return errors.New("txn record without txn")
+		}
+		if _, _, err := applyLocalTxn(*r.Txn); err != nil {
+			return err
+		}
+		gossipTxn.Add(*r.Txn)
+		return nil
+	case "gossip":
+		if r.Gossip == nil {
+			return errors.New("gossip record without data")
+		}
+		return applyGossip(*r.Gossip)
+	}
+	return fmt.Errorf("unknown op %q", r.Op)
+}
+
+// 写日志，没有开启时什么都不做
+func logRecord(r persist.Record) error {
+	if aof == nil {
+		return nil
+	}
+	_, err := aof.Append(r)
+	return err
+}
+
+// 记录一个key写入后的状态，更新已有的key时调用方需要持有它的记录锁，保证日志顺序和写入顺序一致
+func logPut(key string, value interface{}, v int64, expiresAt int64) error {
+	return logRecord(persist.Record{Op: "put", Key: key, Value: value, V: v, ExpiresAt: expiresAt, Update: true})
+}
+
+// 记录删除，调用方需要持有记录锁或者全局写锁
+func logDelete(key string) error {
+	return logRecord(persist.Record{Op: "delete", Key: key})
+}
+
+// 日志最后一条记录的序列号，没有开启时为0
+func walSeq() uint64 {
+	if aof == nil {
+		return 0
+	}
+	return aof.Seq()
+}
+
+// 关闭日志文件，关闭前会fsync
+func closeAOF() error {
+	if aof == nil {
+		return nil
+	}
+	return aof.Close()
+}
+
+// 用当前数据重写日志，返回新日志中的数据条数
+// 开始时加全局写锁确定重写的起点，这时已经写了日志的记录都已经写入数据结构
+// 遍历时不持有全局锁，遍历期间的写入同时追加到旧日志和重写缓冲区，重写结束时接到新日志后面，重放的结果和内存中的数据一致
+func rewriteAOF() (int, error) {
+	now := time.Now().UnixNano()
+	return aof.Rewrite(&globalMutex, func(add func(r persist.Record) error) error {
+		var addErr error
+		err := m.Iterate(func(d *model.DataPair) bool {
+			e := d.Entry()
+			if e.Expired(now) {
+				return true
+			}
+			addErr = add(persist.Record{Op: "put", Key: e.Key, Value: e.Value, V: e.V, ExpiresAt: e.ExpiresAt, Update: e.Update})
+			return addErr == nil
+		})
+		if err != nil {
+			return err
+		}
+		return addErr
+	})
+}
+
+// 读取整数配置，没有配置时使用默认值
+func readIntConfig(key string, def int) (int, error) {
+	s, ok := utils.ReadKey(key)
+	if !ok {
+		return def, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("config %s must be a non-negative integer, got %q", key, s)
+	}
+	return n, nil
+}
+
+// 自动重写，日志不小于aofRewriteMinSizeMB，并且比上次重写后增长了aofRewritePercentage时触发
+// aofRewritePercentage为0时不自动重写
+func AOFRewriter() {
+	if aof == nil {
+		return
+	}
+	percentage, err := readIntConfig("aofRewritePercentage", 100)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	minSizeMB, err := readIntConfig("aofRewriteMinSizeMB", 64)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if percentage == 0 {
+		return
+	}
+	minSize := int64(minSizeMB) << 20
+	t := time.NewTicker(time.Second)
+	for range t.C {
+		size, base := aof.Size()
+		if size < minSize || size < base+base*int64(percentage)/100 {
+			continue
+		}
+		start := time.Now()
+		count, err := rewriteAOF()
+		if err != nil {
+			fmt.Println("aof rewrite:", err)
+			continue
+		}
+		newSize, _ := aof.Size()
+		fmt.Printf("aof rewrite: %d keys, %d -> %d bytes in %v\n", count, size, newSize, time.Since(start))
+	}
+}
+
+// 手动触发重写
+func AdminRewriteAOF(c *gin.Context) {
+	if aof == nil {
+		c.JSON(400, gin.H{"error": "aof is not enabled"})
+		return
+	}
+	before, _ := aof.Size()
+	start := time.Now()
+	count, err := rewriteAOF()
+	if errors.Is(err, persist.ErrRewriteInProgress) {
+		c.JSON(409, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		storageFailed(c, err)
+		return
+	}
+	after, _ := aof.Size()
+	c.JSON(200, gin.H{"message": "rewrite success", "keys": count, "size_before": before, "size_after": after, "duration_ms": time.Since(start).Milliseconds()})
+}
@@ -0,0 +1,110 @@
+// 批量读写，一次请求处理多个key，每个key单独返回结果
+
+package router
+
+import (
+	"github.com/gin-gonic/gin"
+	"time"
+)
+
+// 批量新增或更新，body里的每个key都会写入，整个请求只获取一次全局读锁，插入新key时临时换成写锁
+func MSet(c *gin.Context) {
+	var body map[string]interface{}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if len(body) == 0 {
+		c.JSON(400, gin.H{"error": "keys is empty"})
+		return
+	}
+	// ttl对本次写入的所有key生效
+	var expiresAt int64
+	if c.Query("ttl") != "" {
+		ttl, ok := parseTTL(c)
+		if !ok {
+			return
+		}
+		expiresAt = deadline(ttl)
+	}
+
+	results := make(map[string]gin.H, len(body))
+	globalMutex.RLock()
+	for k, data := range body {
+		version, inserted, err := writeKey(k, data, expiresAt, false)
+		if err != nil {
+			results[k] = gin.H{"error": err.Error()}
+			continue
+		}
+		message := "update success"
+		if inserted {
+			message = "insert success"
+		}
+		results[k] = gin.H{"message": message, "version": version}
+	}
+	globalMutex.RUnlock()
+	c.JSON(200, gin.H{"results": results})
+}
+
+// 批量查询，?key=a&key=b，不存在的key返回found为false
+func MGet(c *gin.Context) {
+	keys := c.QueryArray("key")
+	if len(keys) == 0 {
+		c.JSON(400, gin.H{"error": "keys is empty"})
+		return
+	}
+
+	results := make(map[string]gin.H, len(keys))
+	now := time.Now().UnixNano()
+	globalMutex.RLock()
+	for _, k := range keys {
+		d, ok, err := find(k)
+		if err != nil {
+			results[k] = gin.H{"found": false, "error": err.Error()}
+			continue
+		}
+		if !ok || d.Expired(now) {
+			if ok {
+				notifyExpired(k, d.Expiry())
+			}
+			results[k] = gin.H{"found": false}
+			continue
+		}
+		d.Mu.RLock()
+		results[k] = gin.H{"found": true, "data": d.Value, "version": d.V}
+		d.Mu.RUnlock()
+	}
+	globalMutex.RUnlock()
+	c.JSON(200, gin.H{"results": results})
+}
+
+// 批量删除，?key=a&key=b
+func MDel(c *gin.Context) {
+	keys := c.QueryArray("key")
+	if len(keys) == 0 {
+		c.JSON(400, gin.H{"error": "keys is empty"})
+		return
+	}
+
+	results := make(map[string]gin.H, len(keys))
+	now := time.Now().UnixNano()
+	globalMutex.RLock()
+	for _, k := range keys {
+		d, ok, err := find(k)
+		if err != nil {
+			results[k] = gin.H{"deleted": false, "error": err.Error()}
+			continue
+		}
+		if !ok || d.Expired(now) {
+			results[k] = gin.H{"deleted": false, "message": "key not found"}
+			continue
+		}
+		if err := deleteKey(k, d); err != nil {
+			results[k] = gin.H{"deleted": false, "error": err.Error()}
+			continue
+		}
+		results[k] = gin.H{"deleted": true, "message": "delete success"}
+	}
+	globalMutex.RUnlock()
+	c.JSON(200, gin.H{"results": results})
+}
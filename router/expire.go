@@ -0,0 +1,178 @@
+// 过期删除，包括访问时发现过期的惰性删除和后台定时的主动删除
+// 读请求只做非阻塞的通知，删除操作都在后台加全局写锁完成，删除的key交给gossip传播
+
+package router
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"sync"
+	"sync/atomic"
+	"time"
+	"wr_2/model"
+)
+
+const (
+	// 主动删除的检查间隔
+	sweepInterval = 100 * time.Millisecond
+	// 每次检查最多删除的key数量，限制每次占用的时间
+	sweepLimit = 500
+)
+
+// 所有设置了过期时间的key都会加入这个队列，每个key一条记录
+var expireQueue = model.NewExpireQueue()
+
+// 过期删除计数，lazy是访问时发现过期删除的，active是后台主动删除的
+// dropped是通知chan已满时没有送进去的数量，这些key会交回过期队列由主动删除处理
+var expiredLazy, expiredActive, expireDropped atomic.Int64
+
+// 访问时发现过期的key，由ExpirationMonitor删除
+var expirationData = make(chan model.ExpiredData, 1000)
+
+// 已经送进expirationData还没处理完的key，同一个key只通知一次
+var expirationPending sync.Map
+
+// 已经删除、等待gossip传播的过期key和它们的过期时间
+var gossipExpire = newExpiredSet()
+
+// 读请求发现过期的key时调用，不会阻塞
+// chan满了就放弃通知并计数，同时把key放回过期队列，保证最终会被删除
+func notifyExpired(key string, expiresAt int64) {
+	if _, loaded := expirationPending.LoadOrStore(key, struct{}{}); loaded {
+		return
+	}
+	select {
+	case expirationData <- model.ExpiredData{Key: key, ExpiresAt: expiresAt}:
+	default:
+		expirationPending.Delete(key)
+		expireDropped.Add(1)
+		expireQueue.Push(key, expiresAt)
+	}
+}
+
+// 惰性删除，处理读请求通知的过期key
+func ExpirationMonitor() {
+	for e := range expirationData {
+		if expiresAt, ok := deleteIfExpired(e.Key); ok {
+			expiredLazy.Add(1)
+			gossipExpire.Add(e.Key, expiresAt)
+		}
+		expirationPending.Delete(e.Key)
+	}
+}
+
+// 加全局写锁检查并删除过期的key，通知之后key可能被更新或者取消了过期时间，以当前存储的过期时间为准
+// 返回删除的数据的过期时间
+func deleteIfExpired(key string) (int64, bool) {
+	globalMutex.Lock()
+	defer globalMutex.Unlock()
+	d, ok, err := find(key)
+	if err != nil {
+		fmt.Println(err)
+		return 0, false
+	}
+	if !ok || !d.Expired(time.Now().UnixNano()) {
+		return 0, false
+	}
+	expiresAt := d.Expiry()
+	if err := logDelete(key); err != nil {
+		fmt.Println(err)
+		return 0, false
+	}
+	if err := m.Delete(key); err != nil {
+		fmt.Println(err)
+		return 0, false
+	}
+	return expiresAt, true
+}
+
+// 记录带过期时间的key，供后台主动删除
+func trackExpire(key string, expiresAt int64) {
+	expireQueue.Push(key, expiresAt)
+}
+
+func ExpirationSweeper() {
+	t := time.NewTicker(sweepInterval)
+	for range t.C {
+		sweepExpired()
+	}
+}
+
+// 删除一批到期的key
+func sweepExpired() {
+	due := expireQueue.PopExpired(time.Now().UnixNano(), sweepLimit)
+	if len(due) == 0 {
+		return
+	}
+	var deleted []model.ExpiredData
+	globalMutex.Lock()
+	now := time.Now().UnixNano()
+	for _, e := range due {
+		// 队列里的记录可能已经过时，以当前存储的过期时间为准
+		d, ok, err := find(e.Key)
+		if err != nil {
+			fmt.Println(err)
+			expireQueue.Push(e.Key, e.ExpiresAt)
+			continue
+		}
+		if !ok || !d.Expired(now) {
+			continue
+		}
+		// 删除失败时放回队列，下次再试
+		if err := logDelete(e.Key); err != nil {
+			fmt.Println(err)
+			expireQueue.Push(e.Key, e.ExpiresAt)
+			continue
+		}
+		if err := m.Delete(e.Key); err != nil {
+			fmt.Println(err)
+			expireQueue.Push(e.Key, e.ExpiresAt)
+			continue
+		}
+		deleted = append(deleted, model.ExpiredData{Key: e.Key, ExpiresAt: d.Expiry()})
+	}
+	globalMutex.Unlock()
+	expiredActive.Add(int64(len(deleted)))
+	for _, e := range deleted {
+		gossipExpire.Add(e.Key, e.ExpiresAt)
+	}
+}
+
+// 等待gossip传播的过期key，用来代替固定容量的chan，写入不会阻塞，也不会因为容量不够丢失
+// 同一个key多次过期删除时只保留最后一次的过期时间
+type expiredSet struct {
+	mu   sync.Mutex
+	keys map[string]int64
+}
+
+func newExpiredSet() *expiredSet {
+	return &expiredSet{keys: make(map[string]int64)}
+}
+
+func (s *expiredSet) Add(key string, expiresAt int64) {
+	s.mu.Lock()
+	s.keys[key] = expiresAt
+	s.mu.Unlock()
+}
+
+// 取出全部key并清空集合
+func (s *expiredSet) Drain() []model.ExpiredData {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expired := make([]model.ExpiredData, 0, len(s.keys))
+	for k, expiresAt := range s.keys {
+		expired = append(expired, model.ExpiredData{Key: k, ExpiresAt: expiresAt})
+	}
+	s.keys = make(map[string]int64)
+	return expired
+}
+
+// 过期删除的统计信息
+func ExpireStats(c *gin.Context) {
+	c.JSON(200, gin.H{
+		"lazy":    expiredLazy.Load(),
+		"active":  expiredActive.Load(),
+		"dropped": expireDropped.Load(),
+		"pending": expireQueue.Len(),
+	})
+}
@@ -0,0 +1,72 @@
+package router
+
+import (
+	"fmt"
+	"testing"
+	"time"
+	"wr_2/model"
+)
+
+// 写日志失败时过期的key不删除，放回队列下次再试，日志恢复之后删除
+func TestSweepRetriesFailedDelete(t *testing.T) {
+	r := newTestRouter(t)
+	expireQueue = model.NewExpireQueue()
+	openTestAOF(t)
+	for i := 0; i < 5; i++ {
+		serve(r, "POST", "/insert?ttl=100", `{"a": 1}`)
+	}
+	if n := expireQueue.Len(); n != 1 {
+		t.Fatalf("%d queue entries for one key", n)
+	}
+	d, _ := m.Get("a")
+	past := time.Now().Add(-time.Second).UnixNano()
+	d.ExpiresAt = past
+	trackExpire("a", past)
+
+	closeAOF()
+	sweepExpired()
+	if _, err := m.Get("a"); err != nil {
+		t.Fatalf("deleted without logging: %v", err)
+	}
+	if n := expireQueue.Len(); n != 1 {
+		t.Fatalf("%d queue entries after a failed delete, want 1", n)
+	}
+
+	aof = nil
+	sweepExpired()
+	if _, err := m.Get("a"); err == nil || expireQueue.Len() != 0 {
+		t.Fatalf("not deleted on retry, %d queue entries", expireQueue.Len())
+	}
+}
+
+// 其他节点过期删除的key，本地之后重新写入过的不删除，过期时间相同或者本地也已经过期时删除
+func TestGossipExpiredKeepsNewerWrites(t *testing.T) {
+	r := newTestRouter(t)
+	serve(r, "POST", "/insert", `{"k": 1}`)
+	serve(r, "POST", "/insert?ttl=100", `{"t": 1}`)
+	d, _ := m.Get("t")
+	expiresAt := d.Expiry()
+	serve(r, "POST", "/insert", `{"old": 1}`)
+	d, _ = m.Get("old")
+	d.ExpiresAt = time.Now().Add(-time.Second).UnixNano()
+
+	body := `{"Delete": [{"Key": "k", "ExpiresAt": 123}, {"Key": "t", "ExpiresAt": 456}, {"Key": "old", "ExpiresAt": 789}, {"Key": "missing", "ExpiresAt": 1}]}`
+	if w := serve(r, "POST", "/gossip/recv", body); w.Code != 200 {
+		t.Fatalf("gossip: %d %s", w.Code, w.Body)
+	}
+	if w := serve(r, "GET", "/search?key=k", ""); w.Code != 200 {
+		t.Fatalf("key written after the remote expiry was deleted: %d %s", w.Code, w.Body)
+	}
+	if _, err := m.Get("t"); err != nil {
+		t.Fatal("key with a different deadline was deleted")
+	}
+	if _, err := m.Get("old"); err == nil {
+		t.Fatal("locally expired key was kept")
+	}
+
+	body = fmt.Sprintf(`{"Delete": [{"Key": "t", "ExpiresAt": %d}]}`, expiresAt)
+	serve(r, "POST", "/gossip/recv", body)
+	if _, err := m.Get("t"); err == nil {
+		t.Fatal("key with the same deadline was kept")
+	}
+}
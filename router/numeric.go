@@ -0,0 +1,186 @@
+// 数值的原子加减操作
+
+package router
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"math"
+	"strconv"
+	"time"
+	"wr_2/model"
+)
+
+var (
+	errNotInteger = errors.New("value is not an integer or out of range")
+	errNotFloat   = errors.New("value is not a valid float")
+	errOverflow   = errors.New("increment or decrement would overflow")
+)
+
+// 整数加1或者加by
+func Incr(c *gin.Context) {
+	incrInt(c, 1)
+}
+
+// 整数减1或者减by
+func Decr(c *gin.Context) {
+	incrInt(c, -1)
+}
+
+func incrInt(c *gin.Context, sign int64) {
+	key := c.Query("key")
+	by := int64(1)
+	if raw := c.Query("by"); raw != "" {
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || (sign < 0 && n == math.MinInt64) {
+			c.JSON(400, gin.H{"error": "by must be an integer"})
+			return
+		}
+		by = n
+	}
+	by *= sign
+	value, version, err := applyNumeric(key, func(old interface{}) (interface{}, error) {
+		n, err := toInt64(old)
+		if err != nil {
+			return nil, err
+		}
+		if (by > 0 && n > math.MaxInt64-by) || (by < 0 && n < math.MinInt64-by) {
+			return nil, errOverflow
+		}
+		return n + by, nil
+	})
+	numericResponse(c, value, version, err)
+}
+
+// 浮点数加by
+func IncrByFloat(c *gin.Context) {
+	key := c.Query("key")
+	by, err := strconv.ParseFloat(c.Query("by"), 64)
+	if err != nil || math.IsNaN(by) || math.IsInf(by, 0) {
+		c.JSON(400, gin.H{"error": "by must be a valid float"})
+		return
+	}
+	value, version, err := applyNumeric(key, func(old interface{}) (interface{}, error) {
+		f, err := toFloat64(old)
+		if err != nil {
+			return nil, err
+		}
+		result := f + by
+		if math.IsNaN(result) || math.IsInf(result, 0) {
+			return nil, errNotFloat
+		}
+		return result, nil
+	})
+	numericResponse(c, value, version, err)
+}
+
+// 值不是数字或者溢出时返回400，数据结构出错时返回500
+func numericResponse(c *gin.Context, value interface{}, version int64, err error) {
+	if errors.Is(err, errNotInteger) || errors.Is(err, errNotFloat) || errors.Is(err, errOverflow) {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		storageFailed(c, err)
+		return
+	}
+	c.JSON(200, gin.H{"value": value, "version": version})
+}
+
+// 在记录锁内读取旧值并写入新值，key不存在或已过期时按0处理并插入
+// 修改后标记需要gossip传播，其他节点按版本号覆盖
+func applyNumeric(key string, apply func(old interface{}) (interface{}, error)) (interface{}, int64, error) {
+	globalMutex.RLock()
+	d, ok, err := find(key)
+	if err != nil {
+		globalMutex.RUnlock()
+		return nil, 0, err
+	}
+	if ok && !d.Expired(time.Now().UnixNano()) {
+		value, version, err := applyToPair(d, apply)
+		globalMutex.RUnlock()
+		return value, version, err
+	}
+	globalMutex.RUnlock()
+
+	// 需要插入新key，加全局写锁之后重新检查，避免并发插入时丢失修改
+	globalMutex.Lock()
+	defer globalMutex.Unlock()
+	d, ok, err = find(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	if ok && !d.Expired(time.Now().UnixNano()) {
+		return applyToPair(d, apply)
+	}
+	value, err := apply(nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	d, err = insertKey(key, value, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+	return value, d.V, nil
+}
+
+func applyToPair(d *model.DataPair, apply func(old interface{}) (interface{}, error)) (interface{}, int64, error) {
+	d.Mu.Lock()
+	defer d.Mu.Unlock()
+	value, err := apply(d.Value)
+	if err != nil {
+		return nil, 0, err
+	}
+	version := time.Now().UnixNano()
+	if err := logPut(d.OriginKey, value, version, d.ExpiresAt); err != nil {
+		return nil, 0, err
+	}
+	d.Value = value
+	d.V = version
+	d.Update = true
+	return value, version, nil
+}
+
+// 把存储的值转换成整数，json解析出来的数字是float64，数据库加载的是字符串
+func toInt64(v interface{}) (int64, error) {
+	switch n := v.(type) {
+	case nil:
+		return 0, nil
+	case int64:
+		return n, nil
+	case int:
+		return int64(n), nil
+	case float64:
+		if n != math.Trunc(n) || n < math.MinInt64 || n >= math.MaxInt64 {
+			return 0, errNotInteger
+		}
+		return int64(n), nil
+	case string:
+		i, err := strconv.ParseInt(n, 10, 64)
+		if err != nil {
+			return 0, errNotInteger
+		}
+		return i, nil
+	}
+	return 0, errNotInteger
+}
+
+func toFloat64(v interface{}) (float64, error) {
+	switch n := v.(type) {
+	case nil:
+		return 0, nil
+	case float64:
+		return n, nil
+	case int64:
+		return float64(n), nil
+	case int:
+		return float64(n), nil
+	case string:
+		f, err := strconv.ParseFloat(n, 64)
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return 0, errNotFloat
+		}
+		return f, nil
+	}
+	return 0, errNotFloat
+}
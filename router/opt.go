@@ -5,37 +5,118 @@ package router
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 	"wr_2/model"
+	"wr_2/persist"
 	"wr_2/utils"
 )
 
-// 数据结构初始化
-var m = InitStruct()
+// 数据结构，在LoadData中初始化
+var m model.DataStruct
 
-func InitStruct() model.DataStruct {
-	// config文件读取需要使用的数据结构
+// 加载数据，restore为true时从快照恢复，否则从数据库加载，然后重放本节点的日志
+// 需要在处理请求之前调用
+func LoadData(port string, restore bool) error {
+	m = InitStruct(port)
+	snapshotFile = snapshotPath(port)
+	// 磁盘上的引擎正常关闭时留下的数据可以直接使用，不再加载数据库和快照，只重放之后的日志
+	if durable, ok := m.(model.Durable); ok {
+		if seq, ok := durable.PersistedSeq(); ok {
+			if err := trackLoadedExpire(); err != nil {
+				return err
+			}
+			fmt.Printf("reusing %d keys saved at aof seq %d, seed data and snapshot are not loaded\n", m.Len(), seq)
+			return openAOF(port, seq)
+		}
+	}
+	var seq uint64
+	if restore {
+		var err error
+		if seq, err = restoreSnapshot(snapshotFile); err != nil {
+			return err
+		}
+	} else if err := loadSeed(utils.Start()); err != nil {
+		return err
+	}
+	return openAOF(port, seq)
+}
+
+func InitStruct(port string) model.DataStruct {
+	// config文件读取需要使用的数据结构，按名字从注册的引擎中创建
 	s, ok := utils.ReadKey("dataStruct")
 	if !ok {
 		return nil
 	}
-	var dataStruct model.DataStruct
-	switch s {
-	case "BPTree":
-		dataStruct = model.NewTree()
-	case "Map":
-		dataStruct = model.InitMap()
+	// 引擎读到的port是实际监听的端口，同一台机器上的多个节点用它区分各自的文件
+	config := func(key string) (string, bool) {
+		if key == "port" {
+			return port, true
+		}
+		return utils.ReadKey(key)
+	}
+	dataStruct, err := model.Open(s, config)
+	if err != nil {
+		// 配置错误时直接退出，不带着错误的配置启动
+		panic(err)
 	}
-	sqlData := utils.Start()
+	return dataStruct
+}
+
+// 加载数据库中的数据
+func loadSeed(sqlData []utils.SqlData) error {
+	pairs := make([]*model.DataPair, 0, len(sqlData))
 	for _, data := range sqlData {
 		fmt.Println(data)
-		dataStruct.Insert(utils.ToHash(data.Key), data.Value, data.Key)
+		pairs = append(pairs, model.NewDataPair(data.Key, data.Value, 0))
 	}
-	return dataStruct
+	return loadPairs(pairs)
+}
+
+// 登记数据结构中已有数据的过期时间
+func trackLoadedExpire() error {
+	return m.Iterate(func(d *model.DataPair) bool {
+		if e := d.Entry(); e.ExpiresAt != 0 {
+			trackExpire(e.Key, e.ExpiresAt)
+		}
+		return true
+	})
+}
+
+// 把数据写入空的数据结构，支持批量构建的引擎按key排序后一次构建，其他引擎逐条写入
+// 重复的key和逐条写入一样以最后一条为准，版本号和传播标记沿用pairs中的值
+func loadPairs(pairs []*model.DataPair) error {
+	loader, ok := m.(model.BulkLoader)
+	if !ok {
+		for _, p := range pairs {
+			d, err := m.Put(p.OriginKey, p.Value, p.ExpiresAt)
+			if err != nil {
+				return err
+			}
+			d.V, d.Update = p.V, p.Update
+		}
+		return nil
+	}
+	sort.SliceStable(pairs, func(i, j int) bool {
+		return pairs[i].OriginKey < pairs[j].OriginKey
+	})
+	return loader.Load(func(yield func(*model.DataPair) bool) {
+		for i, p := range pairs {
+			if i+1 < len(pairs) && pairs[i+1].OriginKey == p.OriginKey {
+				continue
+			}
+			if !yield(p) {
+				return
+			}
+		}
+	})
 }
 
 // 全局锁 在普通crud操作中使用读锁，在gossip集中更新时使用写锁
@@ -55,25 +136,129 @@ func InsertAndUpdate(c *gin.Context) {
 	}
 	if k == "" {
 		c.JSON(400, gin.H{"error": "keys is empty"})
+		return
 	}
 	data, _ := body[k]
+	// 没有ttl参数时不过期，更新数据时也会清除原来的过期时间
+	var expiresAt int64
+	if c.Query("ttl") != "" {
+		ttl, ok := parseTTL(c)
+		if !ok {
+			return
+		}
+		expiresAt = deadline(ttl)
+	}
+	expected, conditional, ok := expectedVersion(c)
+	if !ok {
+		return
+	}
 
-	globalMutex.RLock()
-	defer globalMutex.RUnlock()
-	d, _, ok := m.Search(k)
-	if ok == false {
-		// 不存在就插入
-		m.Insert(utils.ToHash(k), data, k)
-		c.JSON(200, gin.H{"message": "insert success"})
+	unlock := lockForWrite(conditional)
+	defer unlock()
+	d, ok, err := find(k)
+	if err != nil {
+		storageFailed(c, err)
+		return
+	}
+	// 已经过期还没删除的key按不存在处理
+	if ok && d.Expired(time.Now().UnixNano()) {
+		ok = false
+	}
+	if conditional {
+		if current := currentVersion(d, ok); current != expected {
+			versionConflict(c, current)
+			return
+		}
+	}
+	version, inserted, err := writeKey(k, data, expiresAt, conditional)
+	if err != nil {
+		storageFailed(c, err)
+		return
+	}
+	if inserted {
+		c.JSON(200, gin.H{"message": "insert success", "version": version})
 	} else {
-		// 存在就先加记录锁，再更新数据
-		(*d).Mu.Lock()
-		d.Value = data
-		d.V = time.Now().UnixNano()
+		c.JSON(200, gin.H{"message": "update success", "version": version})
+	}
+
+}
+
+// 写入一个key，调用方需要持有全局锁，exclusive表示持有的是写锁，返回写入后的版本号以及是否是新插入的
+func writeKey(k string, data interface{}, expiresAt int64, exclusive bool) (int64, bool, error) {
+	d, ok, err := find(k)
+	if err != nil {
+		return 0, false, err
+	}
+	if ok == false || d.Expired(time.Now().UnixNano()) {
+		// 不存在就插入，插入需要全局写锁
+		if !exclusive {
+			return writeKeyExclusive(k, data, expiresAt)
+		}
+		d, err = insertKey(k, data, expiresAt)
+		if err != nil {
+			return 0, false, err
+		}
+		return d.V, true, nil
+	}
+	// 存在就先加记录锁，写日志之后再更新数据
+	(*d).Mu.Lock()
+	version := time.Now().UnixNano()
+	if err := logPut(k, data, version, expiresAt); err != nil {
 		(*d).Mu.Unlock()
-		c.JSON(200, gin.H{"message": "update success"})
+		return 0, false, err
 	}
+	d.Value = data
+	d.V = version
+	d.ExpiresAt = expiresAt
+	d.Update = true
+	(*d).Mu.Unlock()
+	trackExpire(k, expiresAt)
+	return version, false, nil
+}
 
+// 持有全局读锁时插入新key，先换成写锁重新写入，返回前恢复读锁
+func writeKeyExclusive(k string, data interface{}, expiresAt int64) (int64, bool, error) {
+	globalMutex.RUnlock()
+	defer globalMutex.RLock()
+	globalMutex.Lock()
+	defer globalMutex.Unlock()
+	// 换锁期间可能有其他请求插入了同一个key，writeKey会重新查找
+	return writeKey(k, data, expiresAt, true)
+}
+
+// 插入新key并标记需要gossip传播，先写日志再写入数据结构，数据使用日志中的版本号
+// 新key还没有记录锁可以用，调用方需要持有全局写锁，并发插入同一个key时日志顺序和写入顺序才一致
+func insertKey(k string, data interface{}, expiresAt int64) (*model.DataPair, error) {
+	version := time.Now().UnixNano()
+	if err := logPut(k, data, version, expiresAt); err != nil {
+		return nil, err
+	}
+	d, err := m.Put(k, data, expiresAt)
+	if err != nil {
+		return nil, err
+	}
+	d.Mu.Lock()
+	d.V = version
+	d.Mu.Unlock()
+	trackExpire(k, expiresAt)
+	return d, nil
+}
+
+// 查找key，不存在时ok为false，数据结构出错时返回错误
+func find(key string) (*model.DataPair, bool, error) {
+	d, err := m.Get(key)
+	if errors.Is(err, model.ErrNotFound) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return d, true, nil
+}
+
+// 数据结构出错，返回500
+func storageFailed(c *gin.Context, err error) {
+	c.JSON(500, gin.H{"error": err.Error()})
 }
 
 // 查询数据
@@ -82,38 +267,266 @@ func Search(c *gin.Context) {
 	fmt.Println(key)
 	globalMutex.RLock()
 	defer globalMutex.RUnlock()
-	data, _, ok := m.Search(key)
+	data, ok, err := find(key)
+	if err != nil {
+		storageFailed(c, err)
+		return
+	}
 	if !ok {
 		c.JSON(404, gin.H{"message": "key not found"})
 		return
 	}
-	expirationData <- model.ExpiredData{Key: key, CreatedAt: data.CreatedAt}
-	c.JSON(200, gin.H{"data": data.Value})
+	// 已经过期的key交给过期检测删除，本次直接按不存在处理
+	if data.Expired(time.Now().UnixNano()) {
+		notifyExpired(key, data.Expiry())
+		c.JSON(404, gin.H{"message": "key not found"})
+		return
+	}
+	data.Mu.RLock()
+	value, version := data.Value, data.V
+	data.Mu.RUnlock()
+	c.Header("ETag", strconv.Quote(strconv.FormatInt(version, 10)))
+	c.JSON(200, gin.H{"data": value, "version": version})
 
 }
 
 // 删除数据
 func Delete(c *gin.Context) {
 	key := c.Query("key")
-	globalMutex.RLock()
-	defer globalMutex.RUnlock()
-	d, _, ok := m.Search(key)
+	expected, conditional, ok := expectedVersion(c)
 	if !ok {
+		return
+	}
+	unlock := lockForWrite(conditional)
+	defer unlock()
+	d, ok, err := find(key)
+	if err != nil {
+		storageFailed(c, err)
+		return
+	}
+	if !ok || d.Expired(time.Now().UnixNano()) {
 		c.JSON(404, gin.H{"message": "key not found"})
+		return
 	}
 
-	// 先加锁再删除
-	d.Mu.Lock()
-	m.Delete(utils.ToHash(key), key)
-	d.Mu.Unlock()
+	if conditional {
+		if current := currentVersion(d, true); current != expected {
+			versionConflict(c, current)
+			return
+		}
+	}
+	if err := deleteKey(key, d); err != nil {
+		storageFailed(c, err)
+		return
+	}
 	c.JSON(200, gin.H{"message": "delete success"})
 }
 
+// 删除一个已经查到的key，调用方需要持有全局锁
+func deleteKey(key string, d *model.DataPair) error {
+	// 先加锁，写日志之后再删除
+	d.Mu.Lock()
+	defer d.Mu.Unlock()
+	if err := logDelete(key); err != nil {
+		return err
+	}
+	return m.Delete(key)
+}
+
 func Count(c *gin.Context) {
 	c.JSON(200, gin.H{"total": m.Len()})
 
 }
 
+// B+树的统计信息，用来调整config中的treeOrder
+func TreeStats(c *gin.Context) {
+	tree, ok := m.(*model.Tree)
+	if !ok {
+		c.JSON(400, gin.H{"error": "dataStruct is not BPTree"})
+		return
+	}
+	c.JSON(200, tree.Stats())
+}
+
+// 当前引擎的名字和统计信息，不同引擎的统计字段不同，seq是日志最后一条记录的序列号
+func Stats(c *gin.Context) {
+	name, _ := utils.ReadKey("dataStruct")
+	c.JSON(200, gin.H{"engine": name, "stats": m.Stats(), "seq": walSeq()})
+}
+
+// 按层返回B+树的结构并检查树是否正确，levels大于0时只返回最上面几层
+// 检查和导出期间会锁住整棵树，只用来排查问题
+func DebugTree(c *gin.Context) {
+	tree, ok := m.(*model.Tree)
+	if !ok {
+		c.JSON(400, gin.H{"error": "dataStruct is not BPTree"})
+		return
+	}
+	maxLevels := 0
+	if s := c.Query("levels"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			c.JSON(400, gin.H{"error": "levels must be a non-negative integer"})
+			return
+		}
+		maxLevels = n
+	}
+	problem := ""
+	if err := tree.Validate(); err != nil {
+		problem = err.Error()
+	}
+	dump := tree.Dump(maxLevels)
+	levels := make([][]gin.H, 0, len(dump))
+	for _, level := range dump {
+		nodes := make([]gin.H, 0, len(level))
+		for _, n := range level {
+			nodes = append(nodes, gin.H{"keys": n.Keys, "leaf": n.Leaf})
+		}
+		levels = append(levels, nodes)
+	}
+	c.JSON(200, gin.H{"valid": problem == "", "error": problem, "levels": levels})
+}
+
+// 范围查询每页默认条数和最大条数
+const (
+	defaultScanLimit = 100
+	maxScanLimit     = 1000
+)
+
+// 列出key时单次请求最多检查的key数量，glob匹配需要遍历，防止一次请求扫描全部数据
+const maxKeysExamined = 10000
+
+// 读取分页条数参数
+func parseLimit(c *gin.Context) (int, bool) {
+	limit := defaultScanLimit
+	if l := c.Query("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			c.JSON(400, gin.H{"error": "limit must be a positive integer"})
+			return 0, false
+		}
+		limit = n
+	}
+	if limit > maxScanLimit {
+		limit = maxScanLimit
+	}
+	return limit, true
+}
+
+// 列出key，prefix按前缀查询，match按glob模式查询，两者同时存在时都要满足
+// 前缀查询利用有序遍历直接定位到前缀开始的位置，glob从模式的固定前缀开始遍历
+// 返回的cursor是下一次需要检查的key，不为空时作为下一次请求的cursor参数
+func Keys(c *gin.Context) {
+	prefix := c.Query("prefix")
+	match := c.Query("match")
+	limit, ok := parseLimit(c)
+	if !ok {
+		return
+	}
+	if globPrefix := utils.GlobPrefix(match); len(globPrefix) > len(prefix) {
+		if !strings.HasPrefix(globPrefix, prefix) {
+			c.JSON(200, gin.H{"keys": []string{}, "cursor": ""})
+			return
+		}
+		prefix = globPrefix
+	}
+	start := prefix
+	if cursor := c.Query("cursor"); cursor != "" {
+		start = cursor
+	}
+
+	keys := []string{}
+	next := ""
+	examined := 0
+	now := time.Now().UnixNano()
+	globalMutex.RLock()
+	err := m.Ascend(start, func(d *model.DataPair) bool {
+		if !strings.HasPrefix(d.OriginKey, prefix) {
+			return false
+		}
+		if len(keys) >= limit || examined >= maxKeysExamined {
+			next = d.OriginKey
+			return false
+		}
+		examined++
+		if d.Expired(now) {
+			return true
+		}
+		if match == "" || utils.GlobMatch(match, d.OriginKey) {
+			keys = append(keys, d.OriginKey)
+		}
+		return true
+	})
+	globalMutex.RUnlock()
+	if err != nil {
+		storageFailed(c, err)
+		return
+	}
+	c.JSON(200, gin.H{"keys": keys, "cursor": next})
+}
+
+// 范围查询，按key的字典序返回[start, end]内的数据，reverse=true时从end往start倒序返回
+// cursor是上一页返回的游标，也就是下一页的第一个key，不为空时从cursor开始查询
+func Scan(c *gin.Context) {
+	start := c.Query("start")
+	end := c.Query("end")
+	reverse := c.Query("reverse") == "true"
+	limit, ok := parseLimit(c)
+	if !ok {
+		return
+	}
+	if cursor := c.Query("cursor"); cursor != "" {
+		if reverse {
+			end = cursor
+		} else {
+			start = cursor
+		}
+	}
+
+	globalMutex.RLock()
+	defer globalMutex.RUnlock()
+	// 多取一条用来判断是否还有下一页
+	var pairs []*model.DataPair
+	var err error
+	if reverse {
+		pairs, err = rangeReverse(end, start, limit+1)
+	} else {
+		pairs, err = m.Range(start, end, limit+1)
+	}
+	if err != nil {
+		storageFailed(c, err)
+		return
+	}
+	data := []gin.H{}
+	now := time.Now().UnixNano()
+	for i, d := range pairs {
+		if i == limit {
+			break
+		}
+		if e := d.Entry(); !e.Expired(now) {
+			data = append(data, gin.H{"key": e.Key, "value": e.Value})
+		}
+	}
+	next := ""
+	if len(pairs) > limit {
+		next = pairs[limit].OriginKey
+	}
+	c.JSON(200, gin.H{"data": data, "cursor": next})
+}
+
+// 倒序范围查询，从end开始返回不小于start的数据，end为空表示从最大的key开始
+func rangeReverse(end string, start string, limit int) ([]*model.DataPair, error) {
+	var result []*model.DataPair
+	err := m.Descend(end, func(d *model.DataPair) bool {
+		if start != "" && d.OriginKey < start {
+			return false
+		}
+		result = append(result, d)
+		return len(result) < limit
+	})
+	return result, err
+}
+
 // gossip接受并更新数据
 func GossipRecv(c *gin.Context) {
 	var receData model.GossipAllData
@@ -124,22 +537,78 @@ func GossipRecv(c *gin.Context) {
 
 	globalMutex.Lock()
 	defer globalMutex.Unlock()
+	// 整批数据作为一条日志写入之后再应用
+	if err := logRecord(persist.Record{Op: "gossip", Gossip: &receData}); err != nil {
+		storageFailed(c, err)
+		return
+	}
+	if err := applyGossip(receData); err != nil {
+		storageFailed(c, err)
+	}
+}
+
+// 应用一批gossip数据，调用方需要持有全局写锁，出错时停止，已经应用的部分不会回滚
+func applyGossip(receData model.GossipAllData) error {
+	now := time.Now().UnixNano()
 	for _, data := range receData.Update {
-		localData, _, exists := m.Search(data.Key)
-		if exists {
-			if localData.V < data.V {
-				localData.Mu.Lock()
-				localData.V = data.V
-				localData.Value = data.Value
-				localData.Mu.Unlock()
-			}
-		} else {
-			m.Insert(utils.ToHash(data.Key), data.Value, data.Key)
+		if err := applyReplicated(data.Key, data.Value, data.V, data.ExpiresAt); err != nil {
+			return err
+		}
+	}
+	for _, txn := range receData.Txn {
+		if err := applyTxn(txn); err != nil {
+			return err
+		}
+	}
+	for _, e := range receData.Delete {
+		if err := applyExpired(e, now); err != nil {
+			return err
 		}
 	}
-	for _, d := range receData.Delete {
-		m.Delete(utils.ToHash(d), d)
+	return nil
+}
+
+// 删除其他节点过期删除的key，本地的数据在那之后被重新写入、过期时间不同时保留
+func applyExpired(e model.ExpiredData, now int64) error {
+	d, ok, err := find(e.Key)
+	if err != nil || !ok {
+		return err
+	}
+	if d.Expiry() != e.ExpiresAt && !d.Expired(now) {
+		return nil
+	}
+	if err := m.Delete(e.Key); err != nil && !errors.Is(err, model.ErrNotFound) {
+		return err
 	}
+	return nil
+}
+
+// 应用其他节点传来的数据，只有版本号更新时才覆盖，调用方需要持有全局写锁
+// 新插入的数据沿用发送方的版本号，并且不再标记需要传播，发送方已经发给了所有节点
+func applyReplicated(key string, value interface{}, v int64, expiresAt int64) error {
+	localData, exists, err := find(key)
+	if err != nil {
+		return err
+	}
+	if exists {
+		if localData.V < v {
+			localData.Mu.Lock()
+			localData.V = v
+			localData.Value = value
+			localData.ExpiresAt = expiresAt
+			localData.Mu.Unlock()
+			trackExpire(key, expiresAt)
+		}
+		return nil
+	}
+	d, err := m.Put(key, value, expiresAt)
+	if err != nil {
+		return err
+	}
+	d.V = v
+	d.Update = false
+	trackExpire(key, expiresAt)
+	return nil
 }
 
 // 确定gossip消息发送频率
@@ -152,11 +621,6 @@ func HandleGossip(port string) {
 
 // 发送gossip消息
 func GossipSend(port string) {
-	if m.Len() == 0 {
-		return
-	}
-	globalMutex.RLock()
-	defer globalMutex.RUnlock()
 	var nodes = []string{
 		"8080",
 		"8081",
@@ -169,51 +633,31 @@ func GossipSend(port string) {
 			break
 		}
 	}
-	// 需要发送的部分更新数据
+	// 需要发送的部分更新数据，只在收集数据时持有读锁，发送请求时不持有，避免等待写锁的操作把读请求也堵住
+	globalMutex.RLock()
 	gQueue := m.GossipUpdate()
-	var deleteKeys []string
-	for {
-		select {
-		case key := <-gossipExpire:
-			deleteKeys = append(deleteKeys, key)
-		default:
-			goto end
-		}
+	txns := gossipTxn.Drain()
+	globalMutex.RUnlock()
+	expired := gossipExpire.Drain()
+	if len(gQueue) == 0 && len(expired) == 0 && len(txns) == 0 {
+		return
 	}
-end:
-	sendData := model.GossipAllData{Update: gQueue, Delete: deleteKeys}
+	sendData := model.GossipAllData{Update: gQueue, Delete: expired, Txn: txns}
 	for _, node := range nodes {
 		jsonData, err := json.Marshal(sendData)
 		if err != nil {
 			fmt.Println(err)
 			return
 		}
-		// 发送到其他节点
+		// 发送到其他节点，某个节点不可用时继续发送给剩下的节点
 		resp, err := http.Post("http://127.0.0.1:"+node+"/gossip/recv", "application/json", bytes.NewBuffer(jsonData))
 		if err != nil {
 			fmt.Println(err)
-			return
+			continue
 		}
 		resp.Body.Close()
 		if resp.StatusCode != 200 {
-			fmt.Println("Failed to send gossip message to node: ")
-			return
-		}
-	}
-}
-
-var expirationData = make(chan model.ExpiredData, 1000)
-var gossipExpire = make(chan string, 1000)
-
-func ExpirationMonitor() {
-	for e := range expirationData {
-		if time.Since(e.CreatedAt) > 5*time.Second {
-			if _, _, ok := m.Search(e.Key); ok == false {
-				continue
-			}
-			m.Delete(utils.ToHash(e.Key), e.Key)
-			gossipExpire <- e.Key
+			fmt.Println("Failed to send gossip message to node: " + node)
 		}
 	}
-
 }
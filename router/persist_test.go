@@ -0,0 +1,227 @@
+package router
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"wr_2/model"
+	"wr_2/persist"
+)
+
+// 在临时目录中打开日志，返回日志文件的路径
+func openTestAOF(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	var err error
+	if aof, err = persist.OpenAOF(path, persist.FsyncNo, 0); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		closeAOF()
+		aof = nil
+	})
+	return path
+}
+
+// 按key排序的所有数据编码成json，数字经过日志重放之后都是float64，按json比较
+func dump(t *testing.T, ds model.DataStruct) string {
+	t.Helper()
+	entries, err := ds.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.Marshal(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+// 关闭当前的数据结构，换成一个空的，模拟重启
+func restartEmpty() {
+	m.Close()
+	m = model.NewTree()
+}
+
+// 快照记录开始时的日志序列号，恢复时只重放之后的记录，结果和恢复前一样
+func TestRestoreSkipsRecordsInSnapshot(t *testing.T) {
+	r := newTestRouter(t)
+	path := openTestAOF(t)
+	snapshotFile = filepath.Join(t.TempDir(), "dump.snap")
+	for i := 0; i < 10; i++ {
+		serve(r, "POST", "/insert", fmt.Sprintf(`{"k%d": %d}`, i, i))
+	}
+	serve(r, "DELETE", "/delete?key=k3", "")
+	if w := serve(r, "POST", "/admin/snapshot", ""); w.Code != 200 {
+		t.Fatalf("snapshot: %d %s", w.Code, w.Body)
+	}
+	before := walSeq()
+	serve(r, "POST", "/insert", `{"k1": "changed"}`)
+	serve(r, "POST", "/insert", `{"k20": 20}`)
+	serve(r, "DELETE", "/delete?key=k5", "")
+	serve(r, "POST", "/incr?key=k7&by=3", "")
+	want := dump(t, m)
+	if err := closeAOF(); err != nil {
+		t.Fatal(err)
+	}
+
+	restartEmpty()
+	seq, err := restoreSnapshot(snapshotFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seq != before {
+		t.Fatalf("snapshot seq %d, want %d", seq, before)
+	}
+	info, err := persist.ReplayAOF(path, seq, replayRecord)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Skipped != int(before) || info.Records != int(info.Seq-before) {
+		t.Fatalf("replayed %d and skipped %d of %d records, snapshot at %d", info.Records, info.Skipped, info.Seq, before)
+	}
+	if got := dump(t, m); got != want {
+		t.Fatalf("after restore:\n%v\nwant:\n%v", got, want)
+	}
+}
+
+// 重放日志得到的数据必须和内存中的一样
+func checkReplay(t *testing.T, path string) {
+	t.Helper()
+	want := dump(t, m)
+	if err := closeAOF(); err != nil {
+		t.Fatal(err)
+	}
+	restartEmpty()
+	if _, err := persist.ReplayAOF(path, 0, replayRecord); err != nil {
+		t.Fatal(err)
+	}
+	if got := dump(t, m); got != want {
+		t.Fatalf("after replay:\n%v\nwant:\n%v", got, want)
+	}
+}
+
+// 多个请求同时插入同一个新key，日志中的顺序和写入的顺序一致，版本号也和日志中的一样
+func TestConcurrentInsertsMatchLog(t *testing.T) {
+	r := newTestRouter(t)
+	path := openTestAOF(t)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 300; i++ {
+				k := fmt.Sprintf("k%d", i%20)
+				switch {
+				case i%7 == g%7:
+					serve(r, "DELETE", "/delete?key="+k, "")
+				case g%2 == 0:
+					serve(r, "POST", "/insert", fmt.Sprintf(`{%q: %d}`, k, g*1000+i))
+				default:
+					serve(r, "POST", "/mset", fmt.Sprintf(`{%q: %d, "m%d": %d}`, k, g*1000+i, i%20, i))
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	checkReplay(t, path)
+}
+
+// 写入的同时反复重写日志，重写之后的日志重放结果和内存中的一样
+func TestRewriteDuringWrites(t *testing.T) {
+	r := newTestRouter(t)
+	path := openTestAOF(t)
+	var wg sync.WaitGroup
+	for g := 0; g < 6; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 400; i++ {
+				k := fmt.Sprintf("k%d", (g*7+i)%40)
+				switch i % 4 {
+				case 0:
+					serve(r, "DELETE", "/delete?key="+k, "")
+				case 1:
+					serve(r, "POST", "/incr?key="+k+"&by=1", "")
+				default:
+					serve(r, "POST", "/insert", fmt.Sprintf(`{%q: %d}`, k, g*1000+i))
+				}
+			}
+		}(g)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	rewrites := 0
+	for {
+		select {
+		case <-done:
+			if rewrites == 0 {
+				t.Fatal("no rewrite finished during the writes")
+			}
+			checkReplay(t, path)
+			return
+		default:
+		}
+		if w := serve(r, "POST", "/admin/aof/rewrite", ""); w.Code != 200 {
+			t.Fatalf("rewrite: %d %s", w.Code, w.Body)
+		}
+		rewrites++
+	}
+}
+
+// 崩溃前还没有gossip传播的本节点写入，从日志或快照恢复之后继续传播，从其他节点收到的不再传播
+// 日志中不记录传播的时间，已经传播过的写入完整重放之后会再传播一次，接收方按版本号忽略；快照中记录了传播标记
+func TestRestoreKeepsPendingGossip(t *testing.T) {
+	r := newTestRouter(t)
+	path := openTestAOF(t)
+	snapshotFile = filepath.Join(t.TempDir(), "dump.snap")
+	gossipTxn.Drain()
+	serve(r, "POST", "/insert", `{"sent": 1}`)
+	m.GossipUpdate()
+	serve(r, "POST", "/insert", `{"a": 1}`)
+	serve(r, "POST", "/gossip/recv", `{"Update": [{"Key": "remote", "Value": 1, "V": 1}]}`)
+	serve(r, "POST", "/admin/snapshot", "")
+	serve(r, "POST", "/incr?key=b&by=1", "")
+	serve(r, "POST", "/txn", `{"success": [{"op": "put", "key": "c", "value": 1}]}`)
+	gossipTxn.Drain()
+	if err := closeAOF(); err != nil {
+		t.Fatal(err)
+	}
+
+	pending := func() string {
+		var keys []string
+		for _, d := range m.GossipUpdate() {
+			keys = append(keys, d.Key)
+		}
+		for _, txn := range gossipTxn.Drain() {
+			for _, op := range txn.Ops {
+				keys = append(keys, "txn:"+op.Key)
+			}
+		}
+		return fmt.Sprint(keys)
+	}
+	restartEmpty()
+	if _, err := persist.ReplayAOF(path, 0, replayRecord); err != nil {
+		t.Fatal(err)
+	}
+	if got := pending(); got != "[a b sent txn:c]" {
+		t.Fatalf("pending gossip after replay: %s", got)
+	}
+
+	restartEmpty()
+	seq, err := restoreSnapshot(snapshotFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := persist.ReplayAOF(path, seq, replayRecord); err != nil {
+		t.Fatal(err)
+	}
+	if got := pending(); got != "[a b txn:c]" {
+		t.Fatalf("pending gossip after restore: %s", got)
+	}
+}
@@ -9,7 +9,25 @@ func InitRouter(r *gin.Engine) *gin.Engine {
 	r.POST("/insert", InsertAndUpdate)
 	r.GET("/search", Search)
 	r.DELETE("/delete", Delete)
+	r.POST("/mset", MSet)
+	r.GET("/mget", MGet)
+	r.DELETE("/mdel", MDel)
+	r.POST("/txn", Txn)
 	r.GET("/count", Count)
+	r.GET("/stats", Stats)
+	r.GET("/scan", Scan)
+	r.GET("/keys", Keys)
+	r.GET("/ttl", TTL)
+	r.POST("/expire", Expire)
+	r.POST("/persist", Persist)
+	r.GET("/expire/stats", ExpireStats)
+	r.GET("/tree/stats", TreeStats)
+	r.GET("/debug/tree", DebugTree)
+	r.POST("/incr", Incr)
+	r.POST("/decr", Decr)
+	r.POST("/incrbyfloat", IncrByFloat)
+	r.POST("/admin/snapshot", AdminSnapshot)
+	r.POST("/admin/aof/rewrite", AdminRewriteAOF)
 	r.POST("/gossip/recv", GossipRecv)
 
 	return r
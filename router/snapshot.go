@@ -0,0 +1,158 @@
+// 快照，把当前所有数据连同版本号和过期时间写到本节点的快照文件，启动时加上--restore从快照恢复
+// 可以通过/admin/snapshot手动触发，也会按config.json中的snapshotInterval定时执行，正常退出时再执行一次
+
+package router
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+	"wr_2/model"
+	"wr_2/persist"
+	"wr_2/utils"
+)
+
+// 本节点的快照文件，在LoadData中设置
+var snapshotFile string
+
+// 同一时间只执行一个快照
+var snapshotMutex sync.Mutex
+
+// 快照文件路径，目录在config.json的snapshotDir中配置，默认为data
+func snapshotPath(port string) string {
+	dir, ok := utils.ReadKey("snapshotDir")
+	if !ok {
+		dir = "data"
+	}
+	return filepath.Join(dir, "dump-"+port+".snap")
+}
+
+// 从快照恢复数据，返回快照包含的日志序列号，已经过期的数据直接跳过
+// 传播标记沿用快照中的值，快照时还没传播的数据恢复之后继续传播
+func restoreSnapshot(path string) (uint64, error) {
+	start := time.Now()
+	entries, seq, err := persist.ReadSnapshot(path)
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now().UnixNano()
+	pairs := make([]*model.DataPair, 0, len(entries))
+	for _, e := range entries {
+		if e.Expired(now) {
+			continue
+		}
+		d := model.NewDataPair(e.Key, e.Value, e.ExpiresAt)
+		d.V = e.V
+		d.Update = e.Update
+		pairs = append(pairs, d)
+	}
+	if err := loadPairs(pairs); err != nil {
+		return 0, err
+	}
+	for _, d := range pairs {
+		trackExpire(d.OriginKey, d.ExpiresAt)
+	}
+	fmt.Printf("snapshot %s: restored %d keys up to aof seq %d in %v\n", path, len(pairs), seq, time.Since(start))
+	return seq, nil
+}
+
+// 写快照，返回写入的数据条数，调用方需要持有snapshotMutex
+// 遍历时不持有全局锁，每条数据在自己的记录锁内复制，遍历期间的写入可能在快照里也可能不在，但每个key都是某次写入后的完整状态
+// 开始时在全局写锁内读取日志序列号，这时已经写日志的记录都已经应用，快照包含它们的效果，恢复时只重放之后的记录
+func saveSnapshot() (int, error) {
+	globalMutex.Lock()
+	seq := walSeq()
+	globalMutex.Unlock()
+	w, err := persist.CreateSnapshot(snapshotFile, seq)
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now().UnixNano()
+	var writeErr error
+	err = m.Iterate(func(d *model.DataPair) bool {
+		e := d.Entry()
+		if e.Expired(now) {
+			return true
+		}
+		writeErr = w.Add(e)
+		return writeErr == nil
+	})
+	if err == nil {
+		err = writeErr
+	}
+	if err != nil {
+		w.Abort()
+		return 0, err
+	}
+	return w.Count(), w.Commit()
+}
+
+// 手动触发快照
+func AdminSnapshot(c *gin.Context) {
+	if !snapshotMutex.TryLock() {
+		c.JSON(409, gin.H{"error": "snapshot already in progress"})
+		return
+	}
+	defer snapshotMutex.Unlock()
+	start := time.Now()
+	count, err := saveSnapshot()
+	if err != nil {
+		storageFailed(c, err)
+		return
+	}
+	c.JSON(200, gin.H{"message": "snapshot success", "path": snapshotFile, "keys": count, "duration_ms": time.Since(start).Milliseconds()})
+}
+
+// 定时快照，间隔在config.json的snapshotInterval中配置，单位为秒，不配置或者为0时不执行
+func SnapshotScheduler() {
+	s, ok := utils.ReadKey("snapshotInterval")
+	if !ok {
+		return
+	}
+	seconds, err := strconv.Atoi(s)
+	if err != nil || seconds < 0 {
+		fmt.Printf("snapshotInterval must be a non-negative integer of seconds, got %q\n", s)
+		return
+	}
+	if seconds == 0 {
+		return
+	}
+	t := time.NewTicker(time.Duration(seconds) * time.Second)
+	for range t.C {
+		// 上一次快照还没结束时跳过这一次
+		if !snapshotMutex.TryLock() {
+			continue
+		}
+		if _, err := saveSnapshot(); err != nil {
+			fmt.Println("snapshot:", err)
+		}
+		snapshotMutex.Unlock()
+	}
+}
+
+// 正常退出前调用，等正在执行的快照结束后再写一次快照，然后关闭日志文件和数据结构
+func Shutdown() error {
+	snapshotMutex.Lock()
+	defer snapshotMutex.Unlock()
+	count, err := saveSnapshot()
+	if err == nil {
+		fmt.Printf("snapshot %s: saved %d keys\n", snapshotFile, count)
+	}
+	// 关闭日志之后不会再有新的写入，磁盘上的引擎把最后的序列号和数据一起保存，下次启动时直接使用
+	globalMutex.Lock()
+	if cerr := closeAOF(); err == nil {
+		err = cerr
+	}
+	seq := walSeq()
+	globalMutex.Unlock()
+	if durable, ok := m.(model.Durable); ok {
+		durable.SetPersistedSeq(seq)
+	}
+	if cerr := m.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
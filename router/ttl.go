@@ -0,0 +1,112 @@
+// 过期时间相关的路由逻辑
+
+package router
+
+import (
+	"github.com/gin-gonic/gin"
+	"strconv"
+	"time"
+)
+
+// ttl的上限为100年，再大换算成纳秒时间戳会溢出
+const maxTTL = 100 * 365 * 24 * 60 * 60
+
+var errTTL = "ttl must be a positive integer of seconds, at most " + strconv.Itoa(maxTTL)
+
+// 读取ttl参数，单位为秒，必须是不超过上限的正整数
+func parseTTL(c *gin.Context) (int64, bool) {
+	ttl, err := strconv.ParseInt(c.Query("ttl"), 10, 64)
+	if err != nil || ttl <= 0 || ttl > maxTTL {
+		c.JSON(400, gin.H{"error": errTTL})
+		return 0, false
+	}
+	return ttl, true
+}
+
+// 把ttl秒数换算成绝对的过期时间戳
+func deadline(ttl int64) int64 {
+	return time.Now().Add(time.Duration(ttl) * time.Second).UnixNano()
+}
+
+// 查询剩余过期时间，单位为秒，-1表示永不过期
+func TTL(c *gin.Context) {
+	key := c.Query("key")
+	globalMutex.RLock()
+	defer globalMutex.RUnlock()
+	d, ok, err := find(key)
+	if err != nil {
+		storageFailed(c, err)
+		return
+	}
+	now := time.Now().UnixNano()
+	if !ok || d.Expired(now) {
+		c.JSON(404, gin.H{"message": "key not found"})
+		return
+	}
+	d.Mu.RLock()
+	expiresAt := d.ExpiresAt
+	d.Mu.RUnlock()
+	if expiresAt == 0 {
+		c.JSON(200, gin.H{"ttl": -1})
+		return
+	}
+	// 不足一秒按一秒算，避免还没过期就返回0
+	remain := time.Duration(expiresAt - now)
+	c.JSON(200, gin.H{"ttl": int64((remain + time.Second - 1) / time.Second)})
+}
+
+// 给已有的key设置过期时间
+func Expire(c *gin.Context) {
+	key := c.Query("key")
+	ttl, ok := parseTTL(c)
+	if !ok {
+		return
+	}
+	found, err := setExpiresAt(key, deadline(ttl))
+	if err != nil {
+		storageFailed(c, err)
+		return
+	}
+	if !found {
+		c.JSON(404, gin.H{"message": "key not found"})
+		return
+	}
+	c.JSON(200, gin.H{"message": "expire success"})
+}
+
+// 取消key的过期时间
+func Persist(c *gin.Context) {
+	key := c.Query("key")
+	found, err := setExpiresAt(key, 0)
+	if err != nil {
+		storageFailed(c, err)
+		return
+	}
+	if !found {
+		c.JSON(404, gin.H{"message": "key not found"})
+		return
+	}
+	c.JSON(200, gin.H{"message": "persist success"})
+}
+
+// 修改过期时间，同时更新版本号并标记需要gossip传播，让其他节点也使用同一个过期时间
+func setExpiresAt(key string, expiresAt int64) (bool, error) {
+	globalMutex.RLock()
+	defer globalMutex.RUnlock()
+	d, ok, err := find(key)
+	if err != nil || !ok || d.Expired(time.Now().UnixNano()) {
+		return false, err
+	}
+	d.Mu.Lock()
+	version := time.Now().UnixNano()
+	if err := logPut(key, d.Value, version, expiresAt); err != nil {
+		d.Mu.Unlock()
+		return false, err
+	}
+	d.ExpiresAt = expiresAt
+	d.V = version
+	d.Update = true
+	d.Mu.Unlock()
+	trackExpire(key, expiresAt)
+	return true, nil
+}
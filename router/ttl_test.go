@@ -0,0 +1,97 @@
+package router
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"wr_2/model"
+)
+
+// 使用空的B+树和不写日志的路由，测试之间互不影响
+func newTestRouter(t *testing.T) *gin.Engine {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	m = model.NewTree()
+	aof = nil
+	t.Cleanup(func() { m.Close() })
+	return InitRouter(gin.New())
+}
+
+func serve(r *gin.Engine, method string, url string, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	var req *http.Request
+	if body == "" {
+		req = httptest.NewRequest(method, url, nil)
+	} else {
+		req = httptest.NewRequest(method, url, strings.NewReader(body))
+	}
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// 修改过期时间和读取同一个key并发执行，用go test -race检查过期时间的读写都在记录锁内
+func TestExpireConcurrentWithReads(t *testing.T) {
+	r := newTestRouter(t)
+	keys := []string{"a", "b", "c"}
+	for _, k := range keys {
+		if w := serve(r, "POST", "/insert", fmt.Sprintf(`{%q: 1}`, k)); w.Code != 200 {
+			t.Fatalf("insert %s: %d %s", k, w.Code, w.Body)
+		}
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				k := keys[(i+j)%len(keys)]
+				var w *httptest.ResponseRecorder
+				switch (i + j) % 5 {
+				case 0:
+					w = serve(r, "POST", fmt.Sprintf("/expire?key=%s&ttl=%d", k, 100+j), "")
+				case 1:
+					w = serve(r, "POST", "/persist?key="+k, "")
+				case 2:
+					w = serve(r, "GET", "/ttl?key="+k, "")
+				case 3:
+					w = serve(r, "GET", "/mget?key=a&key=b&key=c", "")
+				default:
+					w = serve(r, "GET", "/search?key="+k, "")
+				}
+				if w.Code != 200 {
+					t.Errorf("%d %s", w.Code, w.Body)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if w := serve(r, "GET", "/scan", ""); w.Code != 200 || !strings.Contains(w.Body.String(), `"key":"c"`) {
+		t.Fatalf("scan: %d %s", w.Code, w.Body)
+	}
+}
+
+// 超过上限的ttl换算成时间戳会溢出，返回400
+func TestTTLTooLarge(t *testing.T) {
+	r := newTestRouter(t)
+	serve(r, "POST", "/insert", `{"a": 1}`)
+	for _, url := range []string{
+		"/expire?key=a&ttl=9300000000",
+		fmt.Sprintf("/expire?key=a&ttl=%d", maxTTL+1),
+		"/insert?ttl=9300000000",
+	} {
+		if w := serve(r, "POST", url, `{"a": 2}`); w.Code != 400 {
+			t.Fatalf("%s: %d %s", url, w.Code, w.Body)
+		}
+	}
+	if w := serve(r, "POST", fmt.Sprintf("/expire?key=a&ttl=%d", maxTTL), ""); w.Code != 200 {
+		t.Fatalf("expire at the limit: %d %s", w.Code, w.Body)
+	}
+	if w := serve(r, "GET", "/ttl?key=a", ""); w.Code != 200 || w.Body.String() != fmt.Sprintf(`{"ttl":%d}`, maxTTL) {
+		t.Fatalf("ttl: %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,291 @@
+// 多key事务，先检查所有条件，全部满足时执行success中的操作，否则执行failure中的操作
+// 整个事务在全局写锁内完成，本地要么全部生效要么全部不生效，并作为一个整体通过gossip传播
+
+package router
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"sync"
+	"time"
+	"wr_2/model"
+	"wr_2/persist"
+)
+
+// 事务的检查条件
+// target为exists时检查key是否存在，为version时检查版本号是否等于version，为value时检查值是否等于value
+type TxnCompare struct {
+	Key     string      `json:"key"`
+	Target  string      `json:"target"`
+	Exists  bool        `json:"exists"`
+	Version int64       `json:"version"`
+	Value   interface{} `json:"value"`
+}
+
+// 事务的写操作，op为put或delete，ttl只对put有效，单位为秒
+type TxnOp struct {
+	Op    string      `json:"op"`
+	Key   string      `json:"key"`
+	Value interface{} `json:"value"`
+	TTL   int64       `json:"ttl"`
+}
+
+type TxnRequest struct {
+	Compare []TxnCompare `json:"compare"`
+	Success []TxnOp      `json:"success"`
+	Failure []TxnOp      `json:"failure"`
+}
+
+// 已经提交、等待gossip传播的事务
+var gossipTxn = &txnQueue{}
+
+type txnQueue struct {
+	mu   sync.Mutex
+	txns []model.GossipTxn
+}
+
+func (q *txnQueue) Add(txn model.GossipTxn) {
+	q.mu.Lock()
+	q.txns = append(q.txns, txn)
+	q.mu.Unlock()
+}
+
+func (q *txnQueue) Drain() []model.GossipTxn {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	txns := q.txns
+	q.txns = nil
+	return txns
+}
+
+func Txn(c *gin.Context) {
+	var req TxnRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if msg := validateTxn(req); msg != "" {
+		c.JSON(400, gin.H{"error": msg})
+		return
+	}
+
+	globalMutex.Lock()
+	defer globalMutex.Unlock()
+	succeeded := true
+	for _, cmp := range req.Compare {
+		holds, err := compareHolds(cmp)
+		if err != nil {
+			storageFailed(c, err)
+			return
+		}
+		if !holds {
+			succeeded = false
+			break
+		}
+	}
+	ops := req.Success
+	if !succeeded {
+		ops = req.Failure
+	}
+
+	// 事务内所有写入使用同一个版本号
+	txn := model.GossipTxn{V: time.Now().UnixNano()}
+	for _, op := range ops {
+		var expiresAt int64
+		if op.Op == "put" && op.TTL > 0 {
+			expiresAt = deadline(op.TTL)
+		}
+		txn.Ops = append(txn.Ops, model.GossipTxnOp{Key: op.Key, Value: op.Value, ExpiresAt: expiresAt, Delete: op.Op == "delete"})
+	}
+	// 事务先在内存中应用，全部成功之后作为一条日志写入，任何一步失败都撤销已经执行的操作
+	// 全局写锁保证其他请求看不到中间状态，日志和gossip中只有完整提交的事务
+	results, undo, err := applyLocalTxn(txn)
+	if err == nil && len(txn.Ops) > 0 {
+		err = logRecord(persist.Record{Op: "txn", Txn: &txn})
+	}
+	if err != nil {
+		rollbackTxn(undo)
+		storageFailed(c, err)
+		return
+	}
+	if len(txn.Ops) > 0 {
+		gossipTxn.Add(txn)
+	}
+	c.JSON(200, gin.H{"succeeded": succeeded, "results": results})
+}
+
+// 事务执行前key的状态，用于出错时撤销
+type txnUndo struct {
+	key     string
+	existed bool
+	old     model.Entry
+}
+
+// 应用本节点的事务，调用方需要持有全局写锁
+// 出错时停止，返回的undo记录了已经修改的key原来的状态，调用方用rollbackTxn撤销
+func applyLocalTxn(txn model.GossipTxn) ([]gin.H, []txnUndo, error) {
+	results := make([]gin.H, 0, len(txn.Ops))
+	undo := make([]txnUndo, 0, len(txn.Ops))
+	for _, op := range txn.Ops {
+		d, ok, err := find(op.Key)
+		if err != nil {
+			return nil, undo, err
+		}
+		u := txnUndo{key: op.Key, existed: ok}
+		if ok {
+			u.old = d.Entry()
+		}
+		if !op.Delete {
+			undo = append(undo, u)
+			if err := putTxnKey(op.Key, op.Value, txn.V, op.ExpiresAt, false); err != nil {
+				return nil, undo, err
+			}
+			results = append(results, gin.H{"op": "put", "key": op.Key, "version": txn.V})
+			continue
+		}
+		deleted := ok && !d.Expired(time.Now().UnixNano())
+		if ok {
+			undo = append(undo, u)
+			d.Mu.Lock()
+			err = m.Delete(op.Key)
+			d.Mu.Unlock()
+			if err != nil {
+				return nil, undo, err
+			}
+		}
+		results = append(results, gin.H{"op": "delete", "key": op.Key, "deleted": deleted})
+	}
+	return results, undo, nil
+}
+
+// 倒序恢复事务修改过的key，调用方需要持有全局写锁
+func rollbackTxn(undo []txnUndo) {
+	for i := len(undo) - 1; i >= 0; i-- {
+		if err := restoreTxnKey(undo[i]); err != nil {
+			fmt.Println("txn rollback:", err)
+		}
+	}
+}
+
+func restoreTxnKey(u txnUndo) error {
+	if !u.existed {
+		if err := m.Delete(u.key); err != nil && !errors.Is(err, model.ErrNotFound) {
+			return err
+		}
+		trackExpire(u.key, 0)
+		return nil
+	}
+	return putTxnKey(u.key, u.old.Value, u.old.V, u.old.ExpiresAt, u.old.Update)
+}
+
+// 检查事务请求是否合法，返回错误信息，合法时返回空字符串
+func validateTxn(req TxnRequest) string {
+	for _, cmp := range req.Compare {
+		if cmp.Key == "" {
+			return "compare key is empty"
+		}
+		switch cmp.Target {
+		case "exists", "version", "value":
+		default:
+			return "compare target must be exists, version or value"
+		}
+	}
+	for _, ops := range [][]TxnOp{req.Success, req.Failure} {
+		for _, op := range ops {
+			if op.Key == "" {
+				return "op key is empty"
+			}
+			if op.Op != "put" && op.Op != "delete" {
+				return "op must be put or delete"
+			}
+			if op.TTL < 0 || op.TTL > maxTTL {
+				return errTTL
+			}
+		}
+	}
+	return ""
+}
+
+// 检查单个条件，已经过期的key按不存在处理，调用方需要持有全局锁
+func compareHolds(cmp TxnCompare) (bool, error) {
+	d, ok, err := find(cmp.Key)
+	if err != nil {
+		return false, err
+	}
+	if ok && d.Expired(time.Now().UnixNano()) {
+		ok = false
+	}
+	switch cmp.Target {
+	case "exists":
+		return ok == cmp.Exists, nil
+	case "version":
+		return currentVersion(d, ok) == cmp.Version, nil
+	case "value":
+		if !ok {
+			return false, nil
+		}
+		d.Mu.RLock()
+		defer d.Mu.RUnlock()
+		return jsonEqual(d.Value, cmp.Value), nil
+	}
+	return false, nil
+}
+
+// 按json编码比较两个值，存储的值可能是整数或字符串，请求中的数字解析后都是float64
+func jsonEqual(a interface{}, b interface{}) bool {
+	ja, err := json.Marshal(a)
+	if err != nil {
+		return false
+	}
+	jb, err := json.Marshal(b)
+	if err != nil {
+		return false
+	}
+	return string(ja) == string(jb)
+}
+
+// 按指定的版本号和传播标记写入，事务中的写入不标记单独传播，由事务整体传播，重放日志时也使用
+func putTxnKey(key string, value interface{}, v int64, expiresAt int64, update bool) error {
+	d, ok, err := find(key)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		if d, err = m.Put(key, value, expiresAt); err != nil {
+			return err
+		}
+	}
+	d.Mu.Lock()
+	d.Value = value
+	d.V = v
+	d.ExpiresAt = expiresAt
+	d.Update = update
+	d.Mu.Unlock()
+	trackExpire(key, expiresAt)
+	return nil
+}
+
+// 应用其他节点传来的事务，调用方需要持有全局写锁
+// 每个key按版本号判断，本地版本更新的key不会被事务覆盖或删除
+func applyTxn(txn model.GossipTxn) error {
+	for _, op := range txn.Ops {
+		if !op.Delete {
+			if err := applyReplicated(op.Key, op.Value, txn.V, op.ExpiresAt); err != nil {
+				return err
+			}
+			continue
+		}
+		d, ok, err := find(op.Key)
+		if err != nil {
+			return err
+		}
+		if ok && d.V < txn.V {
+			if err := m.Delete(op.Key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package router
+
+import (
+	"errors"
+	"testing"
+	"wr_2/model"
+)
+
+// 写入指定key时返回错误的数据结构
+type failingPut struct {
+	model.DataStruct
+	key string
+}
+
+func (f failingPut) Put(key string, value interface{}, expiresAt int64) (*model.DataPair, error) {
+	if key == f.key {
+		return nil, errors.New("disk full")
+	}
+	return f.DataStruct.Put(key, value, expiresAt)
+}
+
+// 事务中间一步存储出错时撤销已经执行的操作，不写日志也不gossip
+func TestTxnRollsBackOnStorageError(t *testing.T) {
+	r := newTestRouter(t)
+	openTestAOF(t)
+	expireQueue = model.NewExpireQueue()
+	gossipTxn.Drain()
+	serve(r, "POST", "/insert", `{"a": 1}`)
+	serve(r, "POST", "/insert?ttl=100", `{"c": 3}`)
+	want := dump(t, m)
+	seq := walSeq()
+
+	m = failingPut{DataStruct: m, key: "fail"}
+	body := `{"success": [
+		{"op": "put", "key": "a", "value": 10},
+		{"op": "put", "key": "b", "value": 20, "ttl": 50},
+		{"op": "delete", "key": "c"},
+		{"op": "put", "key": "a", "value": 11},
+		{"op": "put", "key": "fail", "value": 0}
+	]}`
+	if w := serve(r, "POST", "/txn", body); w.Code != 500 {
+		t.Fatalf("txn: %d %s", w.Code, w.Body)
+	}
+	if got := dump(t, m); got != want {
+		t.Fatalf("after failed txn:\n%v\nwant:\n%v", got, want)
+	}
+	if walSeq() != seq {
+		t.Fatal("failed txn was logged")
+	}
+	if txns := gossipTxn.Drain(); len(txns) != 0 {
+		t.Fatalf("failed txn was gossiped: %v", txns)
+	}
+	if n := expireQueue.Len(); n != 1 {
+		t.Fatalf("%d expiry queue entries, want 1", n)
+	}
+}
+
+// 事务中的ttl和单独写入一样有上限
+func TestTxnTTLTooLarge(t *testing.T) {
+	r := newTestRouter(t)
+	if w := serve(r, "POST", "/txn", `{"success": [{"op": "put", "key": "a", "value": 3, "ttl": 9300000000}]}`); w.Code != 400 {
+		t.Fatalf("txn: %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,54 @@
+// 基于数据版本号的条件写入
+
+package router
+
+import (
+	"github.com/gin-gonic/gin"
+	"strconv"
+	"strings"
+	"wr_2/model"
+)
+
+// 读取期望的版本号，优先使用If-Match请求头，其次是expected_version参数
+// 返回的第二个值表示请求是否带了版本条件，版本号0表示要求key不存在
+func expectedVersion(c *gin.Context) (int64, bool, bool) {
+	raw := c.GetHeader("If-Match")
+	if raw == "" {
+		raw = c.Query("expected_version")
+	}
+	if raw == "" {
+		return 0, false, true
+	}
+	// If-Match的值可能按ETag的格式带引号
+	v, err := strconv.ParseInt(strings.Trim(raw, `"`), 10, 64)
+	if err != nil || v < 0 {
+		c.JSON(400, gin.H{"error": "expected version must be a non-negative integer"})
+		return 0, false, false
+	}
+	return v, true, true
+}
+
+// 当前存储的版本号，key不存在时为0
+func currentVersion(d *model.DataPair, exists bool) int64 {
+	if !exists {
+		return 0
+	}
+	d.Mu.RLock()
+	defer d.Mu.RUnlock()
+	return d.V
+}
+
+// 版本不匹配时返回409和当前版本号
+func versionConflict(c *gin.Context, current int64) {
+	c.JSON(409, gin.H{"error": "version mismatch", "version": current})
+}
+
+// 带版本条件的写操作在检查和写入之间不能被其他写操作打断，需要全局写锁，普通写操作使用读锁加记录锁
+func lockForWrite(conditional bool) func() {
+	if conditional {
+		globalMutex.Lock()
+		return globalMutex.Unlock
+	}
+	globalMutex.RLock()
+	return globalMutex.RUnlock
+}
@@ -0,0 +1,111 @@
+package utils
+
+// glob模式匹配，语义与redis的KEYS命令一致
+// 支持 * 匹配任意多个字符，? 匹配单个字符，[abc] [a-z] [^a] 字符集合，\ 转义下一个字符
+func GlobMatch(pattern string, key string) bool {
+	px, kx := 0, 0
+	// 遇到*时记录回溯位置，后续匹配失败时让*多吞一个字符再重试
+	starPx, starKx := -1, -1
+	for px < len(pattern) || kx < len(key) {
+		if px < len(pattern) {
+			switch c := pattern[px]; c {
+			case '*':
+				starPx = px
+				starKx = kx + 1
+				px++
+				continue
+			case '?':
+				if kx < len(key) {
+					px++
+					kx++
+					continue
+				}
+			case '[':
+				if kx < len(key) {
+					matched, width := matchClass(pattern[px:], key[kx])
+					if width == 0 {
+						// 没有闭合的]，按普通字符处理
+						matched, width = key[kx] == '[', 1
+					}
+					if matched {
+						px += width
+						kx++
+						continue
+					}
+				}
+			case '\\':
+				if px+1 < len(pattern) {
+					c = pattern[px+1]
+					if kx < len(key) && key[kx] == c {
+						px += 2
+						kx++
+						continue
+					}
+					break
+				}
+				fallthrough
+			default:
+				if kx < len(key) && key[kx] == c {
+					px++
+					kx++
+					continue
+				}
+			}
+		}
+		if starKx > 0 && starKx <= len(key) {
+			px = starPx
+			kx = starKx
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+// 匹配[...]字符集合，返回是否匹配以及集合在模式中占用的长度，长度为0表示集合没有闭合
+func matchClass(class string, ch byte) (bool, int) {
+	i := 1
+	negate := false
+	if i < len(class) && class[i] == '^' {
+		negate = true
+		i++
+	}
+	matched := false
+	for i < len(class) && class[i] != ']' {
+		lo := class[i]
+		if lo == '\\' && i+1 < len(class) {
+			i++
+			lo = class[i]
+		}
+		if i+2 < len(class) && class[i+1] == '-' && class[i+2] != ']' {
+			hi := class[i+2]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			if ch >= lo && ch <= hi {
+				matched = true
+			}
+			i += 3
+			continue
+		}
+		if ch == lo {
+			matched = true
+		}
+		i++
+	}
+	if i >= len(class) {
+		return false, 0
+	}
+	return matched != negate, i + 1
+}
+
+// glob模式第一个特殊字符之前的固定前缀，匹配的key一定以它开头
+func GlobPrefix(pattern string) string {
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '*', '?', '[', '\\':
+			return pattern[:i]
+		}
+	}
+	return pattern
+}
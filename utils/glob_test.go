@@ -0,0 +1,73 @@
+package utils
+
+import "testing"
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		key     string
+		want    bool
+	}{
+		{"*", "", true},
+		{"*", "abc", true},
+		{"a*", "abc", true},
+		{"a*", "ba", false},
+		{"*c", "abc", true},
+		{"a*c", "ac", true},
+		{"a*c", "abcbd", false},
+		{"a*b*c", "axxbyyc", true},
+		{"a*b*c", "axxcyyb", false},
+		{"**", "x", true},
+		{"?", "a", true},
+		{"?", "", false},
+		{"?", "ab", false},
+		{"a?c", "abc", true},
+		{"a?c", "ac", false},
+		{"*?", "", false},
+		{"[a-c]", "b", true},
+		{"[a-c]", "d", false},
+		{"[c-a]", "b", true},
+		{"[abc]x", "cx", true},
+		{"[abc]x", "dx", false},
+		{"[^x]", "y", true},
+		{"[^x]", "x", false},
+		{"[^a-c]z", "dz", true},
+		{"[^a-c]z", "bz", false},
+		{"[a-]", "-", true},
+		{"[\\]]", "]", true},
+		{"[ab", "[ab", true},
+		{"[ab", "a", false},
+		{"\\*", "*", true},
+		{"\\*", "a", false},
+		{"\\?x", "?x", true},
+		{"a\\[b", "a[b", true},
+		{"a\\", "a\\", true},
+		{"user:*:name", "user:42:name", true},
+		{"user:*:name", "user:42:age", false},
+	}
+	for _, tt := range tests {
+		if got := GlobMatch(tt.pattern, tt.key); got != tt.want {
+			t.Errorf("GlobMatch(%q, %q) = %v, want %v", tt.pattern, tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestGlobPrefix(t *testing.T) {
+	tests := []struct {
+		pattern string
+		want    string
+	}{
+		{"", ""},
+		{"abc", "abc"},
+		{"user:*", "user:"},
+		{"ab?c", "ab"},
+		{"a[bc]", "a"},
+		{"a\\*b", "a"},
+		{"*abc", ""},
+	}
+	for _, tt := range tests {
+		if got := GlobPrefix(tt.pattern); got != tt.want {
+			t.Errorf("GlobPrefix(%q) = %q, want %q", tt.pattern, got, tt.want)
+		}
+	}
+}